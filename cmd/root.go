@@ -5,6 +5,7 @@ package cmd
 
 import (
 	"fmt"
+	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
 	"github.com/desmo999r/formolcli/controllers"
 	"github.com/desmo999r/formolcli/standalone"
 	"github.com/spf13/cobra"
@@ -33,7 +34,10 @@ var backupCmd = &cobra.Command{
 		backupSessionName, _ := cmd.Flags().GetString("name")
 		backupSessionNamespace, _ := cmd.Flags().GetString("namespace")
 		targetName, _ := cmd.Flags().GetString("target-name")
-		standalone.BackupPaths(backupSessionName, backupSessionNamespace, targetName, args...)
+		if err := standalone.BackupPaths(backupSessionName, backupSessionNamespace, targetName, args...); err != nil {
+			// Let the BackupSession controller know the backup Job failed
+			os.Exit(1)
+		}
 	},
 }
 
@@ -44,7 +48,9 @@ var startRestoreSessionCmd = &cobra.Command{
 		restoreSessionName, _ := cmd.Flags().GetString("name")
 		restoreSessionNamespace, _ := cmd.Flags().GetString("namespace")
 		targetName, _ := cmd.Flags().GetString("target-name")
-		standalone.StartRestore(restoreSessionName, restoreSessionNamespace, targetName)
+		if err := standalone.StartRestore(restoreSessionName, restoreSessionNamespace, targetName); err != nil {
+			os.Exit(1)
+		}
 	},
 }
 
@@ -83,6 +89,121 @@ var deleteSnapshotCmd = &cobra.Command{
 	},
 }
 
+var lsSnapshotCmd = &cobra.Command{
+	Use:   "ls <snapshot id|backupsession> [path]",
+	Short: "List the files of a snapshot",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, _ := cmd.Flags().GetString("name")
+		namespace, _ := cmd.Flags().GetString("namespace")
+		targetName, _ := cmd.Flags().GetString("target")
+		path := ""
+		if len(args) > 1 {
+			path = args[1]
+		}
+		if err := standalone.ListSnapshot(namespace, name, args[0], targetName, path); err != nil {
+			os.Exit(1)
+		}
+	},
+}
+
+var findSnapshotCmd = &cobra.Command{
+	Use:   "find <pattern>",
+	Short: "Find files in the snapshots",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, _ := cmd.Flags().GetString("name")
+		namespace, _ := cmd.Flags().GetString("namespace")
+		targetName, _ := cmd.Flags().GetString("target")
+		if err := standalone.FindSnapshot(namespace, name, args[0], targetName); err != nil {
+			os.Exit(1)
+		}
+	},
+}
+
+var dumpSnapshotCmd = &cobra.Command{
+	Use:   "dump <snapshot id|backupsession> <file>",
+	Short: "Write a file of a snapshot to stdout",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, _ := cmd.Flags().GetString("name")
+		namespace, _ := cmd.Flags().GetString("namespace")
+		targetName, _ := cmd.Flags().GetString("target")
+		if err := standalone.DumpSnapshot(namespace, name, args[0], targetName, args[1]); err != nil {
+			os.Exit(1)
+		}
+	},
+}
+
+var diffSnapshotCmd = &cobra.Command{
+	Use:   "diff <snapshot id|backupsession> <snapshot id|backupsession>",
+	Short: "Show the files added, removed and modified between two snapshots",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, _ := cmd.Flags().GetString("name")
+		namespace, _ := cmd.Flags().GetString("namespace")
+		targetName, _ := cmd.Flags().GetString("target")
+		output, _ := cmd.Flags().GetString("output")
+		if err := standalone.DiffSnapshot(namespace, name, args[0], args[1], targetName, output); err != nil {
+			os.Exit(1)
+		}
+	},
+}
+
+var exportSnapshotCmd = &cobra.Command{
+	Use:   "export <backupsession>",
+	Short: "Export the snapshot of a target with its manifest as a tar archive. Compressed if the file name ends with .zst or .gz",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		namespace, _ := cmd.Flags().GetString("namespace")
+		targetName, _ := cmd.Flags().GetString("target")
+		output, _ := cmd.Flags().GetString("output")
+		if err := standalone.ExportSnapshot(namespace, args[0], targetName, output); err != nil {
+			os.Exit(1)
+		}
+	},
+}
+
+var importSnapshotCmd = &cobra.Command{
+	Use:   "import <archive>",
+	Short: "Import an exported snapshot in the repository of a BackupConfiguration and create its BackupSession",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, _ := cmd.Flags().GetString("name")
+		namespace, _ := cmd.Flags().GetString("namespace")
+		targetName, _ := cmd.Flags().GetString("target")
+		if err := standalone.ImportSnapshot(namespace, name, targetName, args[0]); err != nil {
+			os.Exit(1)
+		}
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "All the restore commands that do not need a RestoreSession",
+}
+
+var restoreFileCmd = &cobra.Command{
+	Use:   "file",
+	Short: "Restore a file in the running target container. Run it in the target sidecar",
+	Run: func(cmd *cobra.Command, args []string) {
+		namespace, _ := cmd.Flags().GetString("namespace")
+		backupSessionName, _ := cmd.Flags().GetString("backupsession")
+		targetName, _ := cmd.Flags().GetString("target")
+		path, _ := cmd.Flags().GetString("path")
+		if namespace == "" {
+			// The sidecar runs in the namespace of the target
+			namespace = os.Getenv(formolv1alpha1.POD_NAMESPACE)
+		}
+		if targetName == "" {
+			targetName = os.Getenv(formolv1alpha1.TARGET_NAME)
+		}
+		if err := standalone.RestoreFile(namespace, backupSessionName, targetName, path); err != nil {
+			os.Exit(1)
+		}
+	},
+}
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "formolcli",
@@ -111,10 +232,18 @@ func init() {
 	rootCmd.AddCommand(backupSessionCmd)
 	rootCmd.AddCommand(restoreSessionCmd)
 	rootCmd.AddCommand(snapshotCmd)
+	rootCmd.AddCommand(restoreCmd)
 	backupSessionCmd.AddCommand(createBackupSessionCmd)
 	backupSessionCmd.AddCommand(backupCmd)
 	restoreSessionCmd.AddCommand(startRestoreSessionCmd)
 	snapshotCmd.AddCommand(deleteSnapshotCmd)
+	snapshotCmd.AddCommand(lsSnapshotCmd)
+	snapshotCmd.AddCommand(findSnapshotCmd)
+	snapshotCmd.AddCommand(dumpSnapshotCmd)
+	snapshotCmd.AddCommand(diffSnapshotCmd)
+	snapshotCmd.AddCommand(exportSnapshotCmd)
+	snapshotCmd.AddCommand(importSnapshotCmd)
+	restoreCmd.AddCommand(restoreFileCmd)
 	rootCmd.AddCommand(startServerCmd)
 	createBackupSessionCmd.Flags().String("namespace", "", "The namespace of the BackupConfiguration containing the information about the backup.")
 	createBackupSessionCmd.Flags().String("name", "", "The name of the BackupConfiguration containing the information about the backup.")
@@ -138,4 +267,32 @@ func init() {
 	deleteSnapshotCmd.MarkFlagRequired("snapshot-id")
 	deleteSnapshotCmd.MarkFlagRequired("namespace")
 	deleteSnapshotCmd.MarkFlagRequired("name")
+	restoreFileCmd.Flags().String("namespace", "", "The namespace of the BackupSession. Defaults to the sidecar namespace")
+	restoreFileCmd.Flags().String("backupsession", "", "The name of the BackupSession")
+	restoreFileCmd.Flags().String("target", "", "The name of the target. Defaults to the sidecar target")
+	restoreFileCmd.Flags().String("path", "", "The path of the file in the target container")
+	restoreFileCmd.MarkFlagRequired("backupsession")
+	restoreFileCmd.MarkFlagRequired("path")
+	diffSnapshotCmd.Flags().String("namespace", "", "The namespace of the BackupSessions")
+	diffSnapshotCmd.Flags().String("name", "", "The name of the BackupConfiguration. Defaults to the BackupConfiguration of the BackupSessions")
+	diffSnapshotCmd.Flags().String("target", "", "The name of the target")
+	diffSnapshotCmd.Flags().StringP("output", "o", "text", "The output format: text or json")
+	diffSnapshotCmd.MarkFlagRequired("namespace")
+	exportSnapshotCmd.Flags().String("namespace", "", "The namespace of the BackupSession")
+	exportSnapshotCmd.Flags().String("target", "", "The name of the target")
+	exportSnapshotCmd.Flags().StringP("output", "o", "", "The archive file")
+	exportSnapshotCmd.MarkFlagRequired("namespace")
+	exportSnapshotCmd.MarkFlagRequired("output")
+	importSnapshotCmd.Flags().String("namespace", "", "The namespace of the BackupConfiguration receiving the snapshot")
+	importSnapshotCmd.Flags().String("name", "", "The name of the BackupConfiguration receiving the snapshot")
+	importSnapshotCmd.Flags().String("target", "", "The name of the target. Defaults to the target of the archive")
+	importSnapshotCmd.MarkFlagRequired("namespace")
+	importSnapshotCmd.MarkFlagRequired("name")
+	for _, c := range []*cobra.Command{lsSnapshotCmd, findSnapshotCmd, dumpSnapshotCmd} {
+		c.Flags().String("namespace", "", "The namespace of the BackupConfiguration containing the information about the backup.")
+		c.Flags().String("name", "", "The name of the BackupConfiguration containing the information about the backup.")
+		c.Flags().String("target", "", "The name of the target")
+		c.MarkFlagRequired("namespace")
+		c.MarkFlagRequired("name")
+	}
 }
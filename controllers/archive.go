@@ -0,0 +1,411 @@
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Version of the layout of the snapshot archives
+	ARCHIVE_VERSION = 2
+	// The archive starts with the manifest followed by the files of the snapshot under data/
+	// and the files of its linked snapshots under linked/<snapshot id>/
+	ARCHIVE_MANIFEST   = "manifest.json"
+	ARCHIVE_DATA_DIR   = "data"
+	ARCHIVE_LINKED_DIR = "linked"
+	// Tags of an imported snapshot: import:root=<dir> and import:snapshot=<exported snapshot id>
+	IMPORT_TAG_PREFIX   = "import:"
+	IMPORT_ROOT_KEY     = "root"
+	IMPORT_SNAPSHOT_KEY = "snapshot"
+	// Annotation of the BackupSession created by the import. The value is the exported snapshot id.
+	// The BackupSession is not a backup to run.
+	IMPORTED_ANNOTATION = ANNOTATION_PREFIX + "imported"
+	// Status note of the targets that are not in the imported snapshot
+	NOT_IMPORTED_REASON = "not in the imported snapshot"
+)
+
+// A restic snapshot as listed by restic snapshots --json
+type ResticSnapshot struct {
+	Id       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Paths    []string  `json:"paths"`
+	Tags     []string  `json:"tags"`
+}
+
+// What an exported snapshot is made of
+type ArchiveManifest struct {
+	Version             int                                `json:"version"`
+	TargetName          string                             `json:"targetName"`
+	Snapshot            ResticSnapshot                     `json:"snapshot"`
+	BackupSession       formolv1alpha1.BackupSession       `json:"backupSession"`
+	BackupConfiguration formolv1alpha1.BackupConfiguration `json:"backupConfiguration"`
+	Functions           []formolv1alpha1.Function          `json:"functions,omitempty"`
+	// The stream and device snapshots referenced by the tags of the snapshot
+	LinkedSnapshots []ResticSnapshot `json:"linkedSnapshots,omitempty"`
+}
+
+// Gets the directory of the files of the snapshot in the archive
+func (manifest ArchiveManifest) snapshotDir(snapshotId string) string {
+	if snapshotId == manifest.Snapshot.Id {
+		return ARCHIVE_DATA_DIR
+	}
+	return ARCHIVE_LINKED_DIR + "/" + snapshotId
+}
+
+// Gets the description of a restic snapshot
+func (s Session) GetSnapshot(snapshotId string) (snapshot ResticSnapshot, err error) {
+	output, err := ResticCommand("snapshots", "--json", snapshotId).Output()
+	if err != nil {
+		s.Log.Error(err, "unable to get the snapshot", "snapshotId", snapshotId)
+		return
+	}
+	var snapshots []ResticSnapshot
+	if err = json.Unmarshal(output, &snapshots); err != nil {
+		s.Log.Error(err, "unable to unmarshal json", "data", string(output))
+		return
+	}
+	if len(snapshots) != 1 {
+		err = fmt.Errorf("found %d snapshots with id %s", len(snapshots), snapshotId)
+		return
+	}
+	return snapshots[0], nil
+}
+
+// Writes the manifest and the files of the snapshot and of its linked snapshots as a tar archive.
+// The snapshot cannot be restored without its linked snapshots: the export fails if one is missing.
+func (s Session) ExportSnapshot(w io.Writer, manifest ArchiveManifest) error {
+	manifest.LinkedSnapshots = nil
+	for _, snapshotId := range linkedSnapshotIds(manifest.Snapshot.Id, manifest.Snapshot.Tags) {
+		linked, err := s.GetSnapshot(snapshotId)
+		if err != nil {
+			s.Log.Error(err, "unable to get the linked snapshot", "snapshotId", manifest.Snapshot.Id, "linked", snapshotId)
+			return err
+		}
+		manifest.LinkedSnapshots = append(manifest.LinkedSnapshots, linked)
+	}
+	archive := tar.NewWriter(w)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := archive.WriteHeader(&tar.Header{
+		Name:    ARCHIVE_MANIFEST,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	if _, err := archive.Write(data); err != nil {
+		return err
+	}
+	for _, snapshot := range append([]ResticSnapshot{manifest.Snapshot}, manifest.LinkedSnapshots...) {
+		if err := s.dumpSnapshot(archive, snapshot.Id, manifest.snapshotDir(snapshot.Id)); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// Writes the files of the snapshot in the archive under dir
+func (s Session) dumpSnapshot(archive *tar.Writer, snapshotId string, dir string) error {
+	// restic dumps the whole snapshot as a tar stream. Move its entries under dir.
+	cmd := ResticCommand("dump", "--archive", "tar", snapshotId, "/")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		s.Log.Error(err, "unable to dump the snapshot", "snapshotId", snapshotId)
+		return err
+	}
+	dump := tar.NewReader(stdout)
+	for {
+		header, err := dump.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			s.Log.Error(err, "unable to read the snapshot dump", "stderr", stderr.String())
+			return err
+		}
+		header.Name = dir + "/" + strings.TrimPrefix(header.Name, "/")
+		if err := archive.WriteHeader(header); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+		if _, err := io.Copy(archive, dump); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		s.Log.Error(err, "unable to dump the snapshot", "snapshotId", snapshotId, "stderr", stderr.String())
+		return err
+	}
+	return nil
+}
+
+// Reads the manifest and extracts the files of a snapshot archive under dir.
+// The files of each snapshot end up in its directory of the archive: dir/data, dir/linked/<snapshot id>.
+func (s Session) ExtractArchive(r io.Reader, dir string) (manifest ArchiveManifest, err error) {
+	archive := tar.NewReader(r)
+	header, err := archive.Next()
+	if err != nil {
+		s.Log.Error(err, "unable to read the archive")
+		return
+	}
+	if header.Name != ARCHIVE_MANIFEST {
+		err = fmt.Errorf("the archive does not start with %s", ARCHIVE_MANIFEST)
+		return
+	}
+	if err = json.NewDecoder(archive).Decode(&manifest); err != nil {
+		s.Log.Error(err, "unable to read the manifest")
+		return
+	}
+	// The first version has no linked snapshots
+	if manifest.Version < 1 || manifest.Version > ARCHIVE_VERSION {
+		err = fmt.Errorf("unsupported archive version %d", manifest.Version)
+		return
+	}
+	snapshotDirs := []string{manifest.snapshotDir(manifest.Snapshot.Id)}
+	for _, linked := range manifest.LinkedSnapshots {
+		snapshotDirs = append(snapshotDirs, manifest.snapshotDir(linked.Id))
+	}
+	// The mtime of the directories changes while their content is extracted
+	dirTimes := make(map[string]time.Time)
+	for {
+		if header, err = archive.Next(); err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			s.Log.Error(err, "unable to read the archive")
+			return
+		}
+		snapshotDir := ""
+		for _, d := range snapshotDirs {
+			if strings.HasPrefix(header.Name, d+"/") {
+				snapshotDir = d
+				break
+			}
+		}
+		if snapshotDir == "" {
+			s.Log.V(0).Info("skipping unknown archive entry", "name", header.Name)
+			continue
+		}
+		name := strings.TrimPrefix(header.Name, snapshotDir+"/")
+		// The symlinks already extracted must not lead outside of the directory of the snapshot
+		var path string
+		if path, err = secureJoin(filepath.Join(dir, snapshotDir), name); err != nil {
+			s.Log.Error(err, "unable to resolve the archive entry", "name", header.Name)
+			return
+		}
+		if err = s.extractEntry(archive, header, path); err != nil {
+			s.Log.Error(err, "unable to extract the archive entry", "name", header.Name)
+			return
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirTimes[path] = header.ModTime
+		}
+	}
+	for path, mtime := range dirTimes {
+		if err = os.Chtimes(path, mtime, mtime); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Creates the file, directory or symlink of the archive entry with its owner, mode and mtime
+func (s Session) extractEntry(archive *tar.Reader, header *tar.Header, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	mode := header.FileInfo().Mode()
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, archive)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(header.Linkname, path); err != nil {
+			return err
+		}
+		return os.Lchown(path, header.Uid, header.Gid)
+	default:
+		s.Log.V(0).Info("skipping unsupported archive entry", "name", header.Name, "type", header.Typeflag)
+		return nil
+	}
+	if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+		return err
+	}
+	// After the chown that clears the setuid and setgid bits
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(path, header.ModTime, header.ModTime)
+}
+
+// Backs up the files of an imported snapshot and of its linked snapshots extracted under dir
+// by ExtractArchive. The linked snapshots are imported first so that the tags referencing them
+// get their new ids. Returns the result of the backup of the snapshot.
+func (s Session) BackupImport(dir string, manifest ArchiveManifest, options BackupOptions) (result BackupResult, err error) {
+	// exported snapshot id => imported snapshot id
+	snapshotIds := make(map[string]string)
+	imported := []string{}
+	defer func() {
+		// Don't leave a partial import behind
+		if err != nil && len(imported) > 0 {
+			if output, err := ResticCommand(append([]string{"forget"}, imported...)...).CombinedOutput(); err != nil {
+				s.Log.Error(err, "unable to forget the imported snapshots", "snapshotIds", imported, "output", string(output))
+			}
+		}
+	}()
+	// A linked snapshot only references older snapshots
+	snapshots := append([]ResticSnapshot{}, manifest.LinkedSnapshots...)
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+	for _, snapshot := range append(snapshots, manifest.Snapshot) {
+		if result, err = s.importSnapshot(filepath.Join(dir, manifest.snapshotDir(snapshot.Id)), snapshot, options, snapshotIds); err != nil {
+			s.Log.Error(err, "unable to import the snapshot", "snapshotId", snapshot.Id)
+			return
+		}
+		if result.SnapshotId == "" {
+			err = fmt.Errorf("no snapshot created for the import of snapshot %s", snapshot.Id)
+			return
+		}
+		snapshotIds[snapshot.Id] = result.SnapshotId
+		imported = append(imported, result.SnapshotId)
+	}
+	return
+}
+
+// Backs up the files of one snapshot of the archive extracted under dir
+func (s Session) importSnapshot(dir string, snapshot ResticSnapshot, options BackupOptions, snapshotIds map[string]string) (result BackupResult, err error) {
+	tags, err := importTags(snapshot, snapshotIds)
+	if err != nil {
+		return
+	}
+	options.Tags = append(append([]string{IMPORT_TAG_PREFIX + IMPORT_SNAPSHOT_KEY + "=" + snapshot.Id}, options.Tags...), tags...)
+	snapshotTime := snapshot.Time.Local().Format("2006-01-02 15:04:05")
+	if filename := stdinFilename(snapshot); filename != "" {
+		// restic dump finds the file at the same path when it is backed up with --stdin again
+		file, err := os.Open(filepath.Join(dir, filename))
+		if err != nil {
+			return result, err
+		}
+		defer file.Close()
+		s.Log.V(0).Info("importing snapshot", "snapshotId", snapshot.Id, "filename", filename)
+		cmd := ResticCommand(append(s.backupArgs(options), "--time", snapshotTime, "--stdin", "--stdin-filename", filename)...)
+		cmd.Stdin = file
+		return s.runBackup(cmd)
+	}
+	options.Tags = append(options.Tags, IMPORT_TAG_PREFIX+IMPORT_ROOT_KEY+"="+dir)
+	args := append(s.backupArgs(options), "--time", snapshotTime)
+	paths := []string{}
+	for _, path := range snapshot.Paths {
+		path = filepath.Join(dir, path)
+		if _, err := os.Lstat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		err = fmt.Errorf("no file to import from snapshot %s", snapshot.Id)
+		return
+	}
+	s.Log.V(0).Info("importing snapshot", "snapshotId", snapshot.Id, "paths", paths)
+	return s.runBackup(ResticCommand(append(args, paths...)...))
+}
+
+// Gets the tags of the imported snapshot. The stream: and device: tags get the ids of the
+// imported snapshots. The other tags about the exporting repository are dropped.
+func importTags(snapshot ResticSnapshot, snapshotIds map[string]string) (tags []string, err error) {
+	for _, tag := range snapshot.Tags {
+		switch {
+		case strings.HasPrefix(tag, STREAM_TAG_PREFIX), strings.HasPrefix(tag, DEVICE_TAG_PREFIX):
+			key, snapshotId, _ := strings.Cut(tag, "=")
+			importedId, found := snapshotIds[snapshotId]
+			if !found {
+				return nil, fmt.Errorf("snapshot %s references snapshot %s that is not imported", snapshot.Id, snapshotId)
+			}
+			tags = append(tags, key+"="+importedId)
+		case strings.HasPrefix(tag, OUTPUT_TAG_PREFIX),
+			strings.HasPrefix(tag, VOLUME_TAG_PREFIX),
+			strings.HasPrefix(tag, STREAM_FUNCTION_TAG_PREFIX),
+			strings.HasPrefix(tag, IMAGE_TAG_PREFIX):
+			tags = append(tags, tag)
+		}
+	}
+	return
+}
+
+// Gets the name of the file of a snapshot taken with restic backup --stdin:
+// the image of a raw block volume or the stdout of a Function.
+// Empty for the snapshots of files.
+func stdinFilename(snapshot ResticSnapshot) string {
+	if len(snapshot.Paths) != 1 {
+		return ""
+	}
+	filename := filepath.Base(snapshot.Paths[0])
+	for _, prefix := range []string{IMAGE_TAG_PREFIX, STREAM_FUNCTION_TAG_PREFIX} {
+		for _, value := range getTagValues(snapshot.Tags, prefix) {
+			if value == filename {
+				return filename
+			}
+		}
+	}
+	return ""
+}
+
+// Gets the directory an imported snapshot was backed up from
+func (s Session) getImportRoot(snapshotId string) string {
+	return getTagValues(s.getSnapshotTags(snapshotId), IMPORT_TAG_PREFIX)[IMPORT_ROOT_KEY]
+}
+
+// Returns true if the snapshot was imported from an archive
+func (s Session) IsImportedSnapshot(snapshotId string) bool {
+	_, found := getTagValues(s.getSnapshotTags(snapshotId), IMPORT_TAG_PREFIX)[IMPORT_SNAPSHOT_KEY]
+	return found
+}
+
+// Gets the path of the file before the snapshot was exported
+func trimImportRoot(path string, root string) string {
+	if root == "" {
+		return path
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return path
+	}
+	return filepath.Join("/", rel)
+}
@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+func TestTrimImportRoot(t *testing.T) {
+	tests := []struct {
+		path string
+		root string
+		want string
+	}{
+		{path: "/tmp/formol-import-1/data/file", root: "", want: "/tmp/formol-import-1/data/file"},
+		{path: "/tmp/formol-import-1/data/file", root: "/tmp/formol-import-1", want: "/data/file"},
+		{path: "/tmp/formol-import-1", root: "/tmp/formol-import-1", want: "/"},
+		{path: "/tmp/formol-import-1/", root: "/tmp/formol-import-1", want: "/"},
+		{path: "/tmp/formol-import-12/data", root: "/tmp/formol-import-1", want: "/tmp/formol-import-12/data"},
+		{path: "/tmp/formol-import-1/..file", root: "/tmp/formol-import-1", want: "/..file"},
+		{path: "/tmp", root: "/tmp/formol-import-1", want: "/tmp"},
+		{path: "/data/file", root: "/tmp/formol-import-1", want: "/data/file"},
+	}
+	for _, tt := range tests {
+		if got := trimImportRoot(tt.path, tt.root); got != tt.want {
+			t.Errorf("trimImportRoot(%q, %q) = %q, want %q", tt.path, tt.root, got, tt.want)
+		}
+	}
+}
+
+// A fake restic serving the snapshots described by the files of its directory:
+// <id>.json for restic snapshots and <id>/ for restic dump.
+// The backups are recorded in backup-<n>.args and backup-<n>.stdin.
+const archiveRestic = `cd "$FAKE_RESTIC_DIR"
+case "$1" in
+snapshots)
+	if [ -f "$3.json" ]; then cat "$3.json"; else echo '[]'; fi
+	;;
+dump)
+	cd "$4" && tar -cf - *
+	;;
+backup)
+	n=$(ls backup-*.args 2>/dev/null | wc -l)
+	n=$((n+1))
+	for arg in "$@"; do echo "$arg"; done > backup-$n.args
+	case " $* " in
+	*" --stdin "*) cat > backup-$n.stdin ;;
+	esac
+	echo '{"message_type":"summary","snapshot_id":"imported'$n'","total_duration":1}'
+	;;
+forget)
+	echo "$@" > forget.args
+	;;
+esac
+`
+
+func writeFakeSnapshot(t *testing.T, dir string, snapshot ResticSnapshot, files map[string]string) {
+	t.Helper()
+	data, err := json.Marshal([]ResticSnapshot{snapshot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, snapshot.Id+".json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, snapshot.Id, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExportImportLinkedSnapshots(t *testing.T) {
+	resticDir := fakeRestic(t, archiveRestic)
+	s := Session{Log: logr.Discard(), Name: "backupsession-import"}
+	start := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	// The Function streamed db.sql then the share path was backed up
+	stream := ResticSnapshot{
+		Id:    "stream1",
+		Time:  start,
+		Paths: []string{"/db.sql"},
+		Tags:  []string{"backupsession-1", STREAM_FUNCTION_TAG_PREFIX + "dump=db.sql"},
+	}
+	snapshot := ResticSnapshot{
+		Id:    "main1",
+		Time:  start.Add(time.Minute),
+		Paths: []string{"/formol-shared"},
+		Tags: []string{
+			"backupsession-1",
+			STREAM_FUNCTION_TAG_PREFIX + "dump=db.sql",
+			STREAM_TAG_PREFIX + "db.sql=stream1",
+			OUTPUT_TAG_PREFIX + "version=12",
+		},
+	}
+	writeFakeSnapshot(t, resticDir, stream, map[string]string{"db.sql": "create table"})
+	writeFakeSnapshot(t, resticDir, snapshot, map[string]string{"formol-shared/file": "shared"})
+
+	var archive bytes.Buffer
+	if err := s.ExportSnapshot(&archive, ArchiveManifest{Version: ARCHIVE_VERSION, Snapshot: snapshot}); err != nil {
+		t.Fatalf("ExportSnapshot() failed: %v", err)
+	}
+	dir := t.TempDir()
+	manifest, err := s.ExtractArchive(&archive, dir)
+	if err != nil {
+		t.Fatalf("ExtractArchive() failed: %v", err)
+	}
+	if len(manifest.LinkedSnapshots) != 1 || manifest.LinkedSnapshots[0].Id != "stream1" {
+		t.Fatalf("manifest.LinkedSnapshots = %+v, want the stream snapshot", manifest.LinkedSnapshots)
+	}
+	for path, want := range map[string]string{
+		filepath.Join(dir, ARCHIVE_DATA_DIR, "formol-shared", "file"): "shared",
+		filepath.Join(dir, ARCHIVE_LINKED_DIR, "stream1", "db.sql"):   "create table",
+	} {
+		if got, err := os.ReadFile(path); err != nil || string(got) != want {
+			t.Errorf("extracted %s = %q, %v, want %q", path, got, err, want)
+		}
+	}
+
+	result, err := s.BackupImport(dir, manifest, BackupOptions{})
+	if err != nil {
+		t.Fatalf("BackupImport() failed: %v", err)
+	}
+	if result.SnapshotId != "imported2" {
+		t.Errorf("BackupImport() = %s, want the last imported snapshot imported2", result.SnapshotId)
+	}
+	// The stream is backed up with --stdin again so that restic dump finds it at /db.sql
+	streamArgs := readLines(t, filepath.Join(resticDir, "backup-1.args"))
+	if !contains(streamArgs, "--stdin") || !contains(streamArgs, "db.sql") {
+		t.Errorf("stream import args = %v, want --stdin --stdin-filename db.sql", streamArgs)
+	}
+	if got, _ := os.ReadFile(filepath.Join(resticDir, "backup-1.stdin")); string(got) != "create table" {
+		t.Errorf("stream import stdin = %q, want the streamed file", got)
+	}
+	mainArgs := readLines(t, filepath.Join(resticDir, "backup-2.args"))
+	for _, want := range []string{
+		STREAM_TAG_PREFIX + "db.sql=imported1",
+		STREAM_FUNCTION_TAG_PREFIX + "dump=db.sql",
+		OUTPUT_TAG_PREFIX + "version=12",
+		IMPORT_TAG_PREFIX + IMPORT_SNAPSHOT_KEY + "=main1",
+		IMPORT_TAG_PREFIX + IMPORT_ROOT_KEY + "=" + filepath.Join(dir, ARCHIVE_DATA_DIR),
+		filepath.Join(dir, ARCHIVE_DATA_DIR, "formol-shared"),
+	} {
+		if !contains(mainArgs, want) {
+			t.Errorf("snapshot import args = %v, want %s", mainArgs, want)
+		}
+	}
+	for _, notWanted := range []string{STREAM_TAG_PREFIX + "db.sql=stream1", "backupsession-1"} {
+		if contains(mainArgs, notWanted) {
+			t.Errorf("snapshot import args = %v, want no %s", mainArgs, notWanted)
+		}
+	}
+}
+
+func TestExportMissingLinkedSnapshot(t *testing.T) {
+	resticDir := fakeRestic(t, archiveRestic)
+	s := Session{Log: logr.Discard()}
+	snapshot := ResticSnapshot{
+		Id:    "main1",
+		Paths: []string{"/formol-shared"},
+		Tags:  []string{DEVICE_TAG_PREFIX + "disk=gone"},
+	}
+	writeFakeSnapshot(t, resticDir, snapshot, map[string]string{"formol-shared/file": "shared"})
+	if err := s.ExportSnapshot(io.Discard, ArchiveManifest{Version: ARCHIVE_VERSION, Snapshot: snapshot}); err == nil {
+		t.Error("ExportSnapshot() of a snapshot with a missing linked snapshot succeeded, want an error")
+	}
+}
+
+func TestImportTags(t *testing.T) {
+	snapshot := ResticSnapshot{
+		Id:   "main1",
+		Tags: []string{DEVICE_TAG_PREFIX + "disk=image1", "backupsession-1", VOLUME_TAG_PREFIX + "data=/data"},
+	}
+	got, err := importTags(snapshot, map[string]string{"image1": "imported1"})
+	if err != nil {
+		t.Fatalf("importTags() failed: %v", err)
+	}
+	if want := []string{DEVICE_TAG_PREFIX + "disk=imported1", VOLUME_TAG_PREFIX + "data=/data"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("importTags() = %v, want %v", got, want)
+	}
+	if _, err := importTags(snapshot, nil); err == nil {
+		t.Error("importTags() of a snapshot referencing a snapshot not imported succeeded, want an error")
+	}
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,8 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	batchv1 "k8s.io/api/batch/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"os"
@@ -14,6 +16,11 @@ import (
 	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
 )
 
+const (
+	SNAPSHOT_MIN_BACKOFF = 5 * time.Second
+	SNAPSHOT_MAX_BACKOFF = 2 * time.Minute
+)
+
 type BackupSessionReconciler struct {
 	Session
 	backupSession formolv1alpha1.BackupSession
@@ -35,6 +42,11 @@ func (r *BackupSessionReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		return ctrl.Result{}, err
 	}
 	r.backupSession = backupSession
+	if _, found := backupSession.Annotations[IMPORTED_ANNOTATION]; found {
+		// The snapshot was imported. There is nothing to back up.
+		r.Log.V(0).Info("Imported BackupSession. Nothing to do")
+		return ctrl.Result{}, nil
+	}
 	if len(backupSession.Status.Targets) == 0 {
 		// The main BackupSession controller hasn't assigned a backup task yet
 		// Wait a bit
@@ -70,6 +82,15 @@ func (r *BackupSessionReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 			break
 		}
 	}
+	// Get the outputs of the Functions that already ran for this target
+	r.Outputs = GetOutputs(&backupSession, targetName)
+	r.Vars = map[string]string{
+		FORMOL_SESSION_KIND: "BackupSession",
+		FORMOL_SESSION_NAME: r.Name,
+		FORMOL_NAMESPACE:    r.Namespace,
+		FORMOL_TARGET_NAME:  targetName,
+		FORMOL_BACKUP_PATHS: os.Getenv(formolv1alpha1.BACKUP_PATHS),
+	}
 
 	// Do preliminary checks with the repository
 	if err = r.SetResticEnv(backupConf); err != nil {
@@ -78,6 +99,8 @@ func (r *BackupSessionReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	}
 
 	var newSessionState formolv1alpha1.SessionState
+	// Details about the target status reported in the BackupSession annotations
+	notes := make(map[string]string)
 	switch targetStatus.SessionState {
 	case formolv1alpha1.New:
 		// New session move to Initializing
@@ -111,7 +134,10 @@ func (r *BackupSessionReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 			}
 		case formolv1alpha1.OnlineKind:
 			backupPaths := strings.Split(os.Getenv(formolv1alpha1.BACKUP_PATHS), string(os.PathListSeparator))
-			if backupResult, result := r.BackupPaths(backupPaths); result != nil {
+			backupOptions := GetBackupOptions(backupConf, targetName)
+			backupOptions.Tags = append(backupOptions.Tags, r.OutputTags()...)
+			backupOptions.Tags = append(backupOptions.Tags, r.GetVolumeTags(target, backupPaths)...)
+			if backupResult, result := r.BackupPaths(backupPaths, backupOptions); result != nil {
 				r.Log.Error(result, "unable to backup paths", "target name", targetName, "paths", backupPaths)
 				newSessionState = formolv1alpha1.Failure
 			} else {
@@ -121,12 +147,39 @@ func (r *BackupSessionReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 				targetStatus.Duration = &metav1.Duration{Duration: time.Now().Sub(targetStatus.StartTime.Time)}
 			}
 		case formolv1alpha1.SnapshotKind:
-			if err := r.backupSnapshot(target); err != nil {
+			if err := r.backupSnapshot(target, notes); err != nil {
 				if IsNotReadyToUse(err) {
-					r.Log.V(0).Info("Volume snapshots are not ready. Requeueing")
+					notReady := err.(*NotReadyToUseError)
+					if len(notReady.Messages) > 0 {
+						notes[SNAPSHOT_ERROR_NOTE] = strings.Join(notReady.Messages, "; ")
+					}
+					waiting := time.Since(notReady.Since)
+					timeout := getDurationOption(&backupConf, SNAPSHOT_READY_TIMEOUT_OPTION, targetName, DEFAULT_SNAPSHOT_READY_TIMEOUT)
+					if waiting > timeout {
+						r.Log.Error(err, "Volume snapshots are still not ready. Giving up", "timeout", timeout)
+						newSessionState = formolv1alpha1.Failure
+						notes[REASON_NOTE] = fmt.Sprintf("volume snapshots not ready after %s", timeout)
+						break
+					}
+					// Back off exponentially: wait as long as we already waited
+					requeueAfter := waiting
+					if requeueAfter < SNAPSHOT_MIN_BACKOFF {
+						requeueAfter = SNAPSHOT_MIN_BACKOFF
+					}
+					if requeueAfter > SNAPSHOT_MAX_BACKOFF {
+						requeueAfter = SNAPSHOT_MAX_BACKOFF
+					}
+					r.Log.V(0).Info("Volume snapshots are not ready. Requeueing", "after", requeueAfter)
+					if err := r.setStatusNotes(&backupSession, targetName, notes); err != nil {
+						r.Log.Error(err, "unable to report the target status details")
+					}
 					return ctrl.Result{
-						Requeue: true,
+						RequeueAfter: requeueAfter,
 					}, nil
+				} else if IsNotSnapshottable(err) || IsInvalidSnapshotClass(err) {
+					r.Log.Error(err, "some volumes cannot be snapshotted. Giving up")
+					newSessionState = formolv1alpha1.Failure
+					notes[REASON_NOTE] = err.Error()
 				} else {
 					r.Log.Error(err, "unable to do snapshot backup")
 					return ctrl.Result{}, err
@@ -141,6 +194,9 @@ func (r *BackupSessionReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		if result = r.runFinalizeSteps(target); result != nil {
 			r.Log.Error(err, "unable to run finalize steps")
 		}
+		if err := r.removeGroupSnapshotLabels(targetName); err != nil {
+			r.Log.Error(err, "unable to remove the group snapshot labels")
+		}
 		if target.BackupType == formolv1alpha1.SnapshotKind {
 			// SnapshotKind special state where we wait for the backup Job to finish
 			newSessionState = formolv1alpha1.WaitingForJob
@@ -151,17 +207,53 @@ func (r *BackupSessionReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 				newSessionState = formolv1alpha1.Success
 			}
 		}
+	case formolv1alpha1.WaitingForJob:
+		// The snapshot backup Job updates the target status once the backup is done.
+		// Here we deal with the Job failures.
+		if state, reason := r.checkSnapshotJob(target, targetStatus); state != "" {
+			r.Log.V(0).Info("The snapshot backup Job is over", "state", state, "reason", reason)
+			newSessionState = state
+			if reason != "" {
+				notes[REASON_NOTE] = reason
+			}
+		}
 	case formolv1alpha1.Success:
 		// Target backup is a success
 		r.Log.V(0).Info("Backup was a success")
 	case formolv1alpha1.Failure:
 		// Target backup is a failure
 	}
+	if target.BackupType == formolv1alpha1.SnapshotKind &&
+		(newSessionState == formolv1alpha1.Failure || (newSessionState == "" && targetStatus.SessionState == formolv1alpha1.Failure)) {
+		// Don't leave the snapshot volumes behind when the backup failed or was cancelled
+		if err := r.DeleteSnapshotVolumes(r.Namespace, r.Name, targetName); err != nil {
+			r.Log.Error(err, "unable to delete the snapshot volumes")
+		}
+		if err := r.removeGroupSnapshotLabels(targetName); err != nil {
+			r.Log.Error(err, "unable to remove the group snapshot labels")
+		}
+		// Don't leave the target quiesced
+		if err := r.unquiesceTarget(target, notes); err != nil {
+			r.Log.Error(err, "unable to unquiesce the target")
+		} else if newSessionState == "" {
+			if err := r.setStatusNotes(&backupSession, targetName, notes); err != nil {
+				r.Log.Error(err, "unable to report the target status details")
+			}
+		}
+	}
 	if newSessionState != "" {
 		targetStatus.SessionState = newSessionState
 		err := r.Status().Update(ctx, &backupSession)
 		if err != nil {
 			r.Log.Error(err, "unable to update BackupSession status")
+			return ctrl.Result{}, err
+		}
+		if err = r.saveOutputs(&backupSession, targetName); err != nil {
+			r.Log.Error(err, "unable to save the Function outputs")
+			return ctrl.Result{}, err
+		}
+		if err = r.setStatusNotes(&backupSession, targetName, notes); err != nil {
+			r.Log.Error(err, "unable to report the target status details")
 		}
 		return ctrl.Result{}, err
 	}
@@ -173,5 +265,6 @@ func (r *BackupSessionReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 func (r *BackupSessionReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&formolv1alpha1.BackupSession{}).
+		Owns(&batchv1.Job{}).
 		Complete(r)
 }
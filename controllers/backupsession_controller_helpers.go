@@ -1,6 +1,9 @@
 package controllers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
 	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
 	batchv1 "k8s.io/api/batch/v1"
@@ -9,23 +12,62 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"os"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"strings"
+	"time"
 )
 
 const (
 	JOBTTL int32 = 7200
+	// Labels of the VolumeSnapshots and the PVCs created for a SnapshotKind backup
+	BACKUPSESSION_LABEL = "backupsession"
+	BACKUPCONF_LABEL    = "backupconfiguration"
+	TARGET_LABEL        = "target"
+	// Note listing the volumes that could not be snapshotted and what was done with them
+	UNSNAPSHOTTABLE_VOLUMES_NOTE = "unsnapshottable-volumes"
+	// The default VolumeSnapshotClass of a CSI driver has this annotation set to "true"
+	DEFAULT_SNAPSHOT_CLASS_ANNOTATION = "snapshot.storage.kubernetes.io/is-default-class"
+	// The name of a Job ends up in the job-name label of its Pods. A label value is at most 63 characters.
+	MAX_JOB_NAME_LENGTH = 63
 )
 
 func (r *BackupSessionReconciler) backupJob(target formolv1alpha1.Target) (result BackupResult, err error) {
 	paths := []string{}
+	backupOptions := GetBackupOptions(r.backupConf, target.TargetName)
+	backupOptions.Tags = append(backupOptions.Tags, r.OutputTags()...)
 	for _, container := range target.Containers {
+		contextVars := r.getContextVars(container, BACKUP_PHASE)
+		streamed := 0
 		for _, job := range container.Job {
-			if err = r.runFunction(*job.Backup); err != nil {
+			function, env, e := r.getFunction(*job.Backup, contextVars)
+			if e != nil {
+				err = e
+				return
+			}
+			if filename := getStreamFilename(function); filename != "" {
+				// The restore finds out from the snapshot how the Function was backed up
+				backupOptions.Tags = append(backupOptions.Tags, STREAM_FUNCTION_TAG_PREFIX+*job.Backup+"="+filename)
+				// The Function stdout goes straight to restic
+				if result, err = r.backupFunctionStdout(function, env, filename, backupOptions); err != nil {
+					r.Log.Error(err, "unable to backup job stdout")
+					return
+				}
+				// The snapshots of the streamed Functions reference each other
+				// so the last snapshot knows about all of them.
+				backupOptions.Tags = append(backupOptions.Tags, STREAM_TAG_PREFIX+filename+"="+result.SnapshotId)
+				streamed++
+				continue
+			}
+			if err = r.runTargetContainerChroot(env, function.Spec.Command[0], function.Spec.Args...); err != nil {
 				r.Log.Error(err, "unable to run job")
 				return
 			}
 
 		}
+		if len(container.Job) > 0 && streamed == len(container.Job) {
+			// Nothing has been written in the SharePath
+			continue
+		}
 		addPath := true
 		for _, path := range paths {
 			if path == container.SharePath {
@@ -36,11 +78,13 @@ func (r *BackupSessionReconciler) backupJob(target formolv1alpha1.Target) (resul
 			paths = append(paths, container.SharePath)
 		}
 	}
-	result, err = r.BackupPaths(paths)
+	if len(paths) > 0 {
+		result, err = r.BackupPaths(paths, backupOptions)
+	}
 	return
 }
 
-func (r *BackupSessionReconciler) backupSnapshot(target formolv1alpha1.Target) (e error) {
+func (r *BackupSessionReconciler) backupSnapshot(target formolv1alpha1.Target, notes map[string]string) error {
 	targetObject, targetPodSpec := formolv1alpha1.GetTargetObjects(target.TargetKind)
 	if err := r.Get(r.Context, client.ObjectKey{
 		Namespace: r.Namespace,
@@ -49,74 +93,242 @@ func (r *BackupSessionReconciler) backupSnapshot(target formolv1alpha1.Target) (
 		r.Log.Error(err, "cannot get target", "target", target.TargetName)
 		return err
 	}
-	for _, container := range targetPodSpec.Containers {
-		for _, targetContainer := range target.Containers {
-			if targetContainer.Name == container.Name {
-				// Now snapshot all the container PVC that support snapshots
-				// then create new volumes from the snapshots
-				// replace the volumes in the container struct with the snapshot volumes
-				// use formolv1alpha1.GetVolumeMounts to get the volume mounts for the Job
-				// sidecar := formolv1alpha1.GetSidecar(backupConf, target)
-				paths, vms := formolv1alpha1.GetVolumeMounts(container, targetContainer)
-				if err := r.snapshotVolumes(vms, targetPodSpec); err != nil {
-					if IsNotReadyToUse(err) {
-						r.Log.V(0).Info("Some volumes are still not ready to use")
-						defer func() { e = &NotReadyToUseError{} }()
-					} else {
-						r.Log.Error(err, "cannot snapshot the volumes")
-						return err
-					}
-				} else {
-					r.Log.V(1).Info("Creating a Job to backup the Snapshot volumes")
-					sidecar := formolv1alpha1.GetSidecar(r.backupConf, target)
-					sidecar.Args = append([]string{"backupsession", "backup", "--namespace", r.Namespace, "--name", r.Name, "--target-name", target.TargetName}, paths...)
-					sidecar.VolumeMounts = vms
-					if env, err := r.getResticEnv(r.backupConf); err != nil {
-						r.Log.Error(err, "unable to get restic env")
-						return err
-					} else {
-						sidecar.Env = append(sidecar.Env, env...)
-					}
-					sidecar.Env = append(sidecar.Env, corev1.EnvVar{
-						Name:  formolv1alpha1.BACKUP_PATHS,
-						Value: strings.Join(paths, string(os.PathListSeparator)),
-					})
-					job := batchv1.Job{
-						ObjectMeta: metav1.ObjectMeta{
-							Namespace: r.Namespace,
-							Name:      "backupsnapshot-" + r.Name,
-						},
-						Spec: batchv1.JobSpec{
-							TTLSecondsAfterFinished: func() *int32 { ttl := JOBTTL; return &ttl }(),
-							Template: corev1.PodTemplateSpec{
-								Spec: corev1.PodSpec{
-									Volumes: targetPodSpec.Volumes,
-									Containers: []corev1.Container{
-										sidecar,
-									},
-									RestartPolicy: corev1.RestartPolicyNever,
-								},
-							},
-						},
-					}
-					if err := r.Create(r.Context, &job); err != nil {
-						r.Log.Error(err, "unable to create the snapshot volumes backup job", "job", job, "container", sidecar)
-						return err
-					}
-					r.Log.V(1).Info("snapshot volumes backup job created", "job", job.Name)
-				}
-			}
+	// Gather the volumes of all the target containers
+	// so a single Job backs them up
+	paths, vms, err := getTargetVolumeMounts(target, targetPodSpec)
+	if err != nil {
+		r.Log.Error(err, "cannot backup the volumes in a single Job")
+		return err
+	}
+	// The raw block volumes are backed up as images
+	devices, err := getTargetVolumeDevices(target, targetPodSpec)
+	if err != nil {
+		r.Log.Error(err, "cannot backup the volumes in a single Job")
+		return err
+	}
+	// Now snapshot all the PVC that support snapshots
+	// then create new volumes from the snapshots
+	// and replace the volumes in the Pod spec with the snapshot volumes
+	skipped, err := r.snapshotVolumes(target, volumeNames(vms, devices), targetPodSpec, notes)
+	if err != nil {
+		if IsNotReadyToUse(err) {
+			r.Log.V(0).Info("Some volumes are still not ready to use")
+		} else {
+			r.Log.Error(err, "cannot snapshot the volumes")
+		}
+		return err
+	}
+	paths, vms = removeVolumeMounts(paths, vms, skipped)
+	devices = removeVolumeDevices(devices, skipped)
+	if len(vms) == 0 && len(devices) == 0 {
+		// Nothing left to backup
+		return &NotSnapshottableError{Volumes: skipped}
+	}
+	r.Log.V(1).Info("Creating a Job to backup the Snapshot volumes")
+	sidecar := formolv1alpha1.GetSidecar(r.backupConf, target)
+	sidecar.Args = append([]string{"backupsession", "backup", "--namespace", r.Namespace, "--name", r.Name, "--target-name", target.TargetName}, paths...)
+	sidecar.VolumeMounts = vms
+	sidecar.VolumeDevices = devices
+	if env, err := r.getResticEnv(r.backupConf); err != nil {
+		r.Log.Error(err, "unable to get restic env")
+		return err
+	} else {
+		sidecar.Env = append(sidecar.Env, env...)
+	}
+	sidecar.Env = append(sidecar.Env, corev1.EnvVar{
+		Name:  formolv1alpha1.BACKUP_PATHS,
+		Value: strings.Join(paths, string(os.PathListSeparator)),
+	}, corev1.EnvVar{
+		Name:  BACKUP_DEVICES,
+		Value: FormatBackupDevices(devices),
+	})
+	job := batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: r.Namespace,
+			Name:      r.snapshotJobName(target),
+		},
+		Spec: batchv1.JobSpec{
+			TTLSecondsAfterFinished: func() *int32 { ttl := JOBTTL; return &ttl }(),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Volumes: targetPodSpec.Volumes,
+					Containers: []corev1.Container{
+						sidecar,
+					},
+					RestartPolicy: corev1.RestartPolicyNever,
+				},
+			},
+		},
+	}
+	// The BackupSession controller watches the Job to catch its failures
+	if err := controllerutil.SetControllerReference(&r.backupSession, &job, r.Scheme); err != nil {
+		r.Log.Error(err, "unable to set the snapshot volumes backup job owner", "job", job.Name)
+		return err
+	}
+	if err := r.Create(r.Context, &job); err != nil {
+		if errors.IsAlreadyExists(err) {
+			r.Log.V(0).Info("snapshot volumes backup job already exists", "job", job.Name)
+			return nil
 		}
+		r.Log.Error(err, "unable to create the snapshot volumes backup job", "job", job, "container", sidecar)
+		return err
 	}
+	r.Log.V(1).Info("snapshot volumes backup job created", "job", job.Name)
 	return nil
 }
 
-type NotReadyToUseError struct{}
+// Removes the mounts of the volumes, and the paths they hold, from the backup
+func removeVolumeMounts(paths []string, vms []corev1.VolumeMount, volumes []string) ([]string, []corev1.VolumeMount) {
+	if len(volumes) == 0 {
+		return paths, vms
+	}
+	keptVms := []corev1.VolumeMount{}
+	removedPaths := []string{}
+NEXT_VM:
+	for _, vm := range vms {
+		for _, volume := range volumes {
+			if vm.Name == volume {
+				removedPaths = append(removedPaths, vm.MountPath)
+				continue NEXT_VM
+			}
+		}
+		keptVms = append(keptVms, vm)
+	}
+	keptPaths := []string{}
+NEXT_PATH:
+	for _, path := range paths {
+		for _, removedPath := range removedPaths {
+			if path == removedPath || strings.HasPrefix(path, strings.TrimSuffix(removedPath, "/")+"/") {
+				continue NEXT_PATH
+			}
+		}
+		keptPaths = append(keptPaths, path)
+	}
+	return keptPaths, keptVms
+}
+
+// Removes the devices of the volumes from the backup
+func removeVolumeDevices(devices []corev1.VolumeDevice, volumes []string) []corev1.VolumeDevice {
+	keptDevices := []corev1.VolumeDevice{}
+NEXT_DEVICE:
+	for _, device := range devices {
+		for _, volume := range volumes {
+			if device.Name == volume {
+				continue NEXT_DEVICE
+			}
+		}
+		keptDevices = append(keptDevices, device)
+	}
+	return keptDevices
+}
+
+// One Job backs up all the volumes of the target
+func (r *BackupSessionReconciler) snapshotJobName(target formolv1alpha1.Target) string {
+	return jobName("backupsnapshot", r.Name, target.TargetName)
+}
+
+// Builds the name of a Job from its parts. A name too long is truncated
+// and ends with a hash of the full name so it stays unique.
+func jobName(parts ...string) string {
+	name := strings.Join(parts, "-")
+	if len(name) <= MAX_JOB_NAME_LENGTH {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:8]
+	return strings.TrimRight(name[:MAX_JOB_NAME_LENGTH-len(hash)-1], "-.") + "-" + hash
+}
+
+// Checks the snapshot backup Job of the target.
+// Returns the new state of the target once the Job is over and why it failed.
+func (r *BackupSessionReconciler) checkSnapshotJob(target formolv1alpha1.Target, targetStatus *formolv1alpha1.TargetStatus) (formolv1alpha1.SessionState, string) {
+	job := batchv1.Job{}
+	if err := r.Get(r.Context, client.ObjectKey{
+		Namespace: r.Namespace,
+		Name:      r.snapshotJobName(target),
+	}, &job); err != nil {
+		if errors.IsNotFound(err) {
+			r.Log.Error(err, "the snapshot backup job is gone", "job", r.snapshotJobName(target))
+			return formolv1alpha1.Failure, "the snapshot backup Job is gone"
+		}
+		r.Log.Error(err, "unable to get the snapshot backup job", "job", r.snapshotJobName(target))
+		return "", ""
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobFailed:
+			// BackoffLimitExceeded, DeadlineExceeded, ...
+			return formolv1alpha1.Failure, condition.Reason + ": " + condition.Message
+		case batchv1.JobComplete:
+			// The Job sets the snapshot ID once the backup is done
+			if targetStatus.SnapshotId == "" {
+				return formolv1alpha1.Failure, "the snapshot backup Job completed without a snapshot"
+			}
+			return formolv1alpha1.Success, ""
+		}
+	}
+	// The Job is still running
+	return "", ""
+}
+
+type NotReadyToUseError struct {
+	// When the oldest snapshot which is not ready was created
+	Since time.Time
+	// Some snapshots are not taken yet
+	Pending bool
+	// The errors reported by the snapshots
+	Messages []string
+}
 
 func (e *NotReadyToUseError) Error() string {
+	if len(e.Messages) > 0 {
+		return "Snapshot is not ready to use: " + strings.Join(e.Messages, "; ")
+	}
 	return "Snapshot is not ready to use"
 }
 
+// Merges the not ready errors of several snapshots
+func (e *NotReadyToUseError) merge(other *NotReadyToUseError) {
+	if e.Since.IsZero() || other.Since.Before(e.Since) {
+		e.Since = other.Since
+	}
+	e.Messages = append(e.Messages, other.Messages...)
+	e.Pending = e.Pending || other.Pending
+}
+
+// Some volumes of the target cannot be snapshotted and the policy is to fail
+type NotSnapshottableError struct {
+	Volumes []string
+}
+
+func (e *NotSnapshottableError) Error() string {
+	return "cannot snapshot volumes " + strings.Join(e.Volumes, ", ")
+}
+
+func IsNotSnapshottable(err error) bool {
+	_, ok := err.(*NotSnapshottableError)
+	return ok
+}
+
+// The VolumeSnapshotClass set with the volume-snapshot-class option cannot be used
+type InvalidSnapshotClassError struct {
+	Class  string
+	PVC    string
+	Reason string
+}
+
+func (e *InvalidSnapshotClassError) Error() string {
+	return fmt.Sprintf("cannot snapshot pvc %s with VolumeSnapshotClass %s: %s", e.PVC, e.Class, e.Reason)
+}
+
+func IsInvalidSnapshotClass(err error) bool {
+	_, ok := err.(*InvalidSnapshotClassError)
+	return ok
+}
+
 func IsNotReadyToUse(err error) bool {
 	switch err.(type) {
 	case *NotReadyToUseError:
@@ -126,7 +338,16 @@ func IsNotReadyToUse(err error) bool {
 	}
 }
 
-func (r *BackupSessionReconciler) snapshotVolume(volume corev1.Volume) (*volumesnapshotv1.VolumeSnapshot, error) {
+// The labels of the VolumeSnapshots and the PVCs created to backup the target
+func (r *BackupSessionReconciler) snapshotLabels(target formolv1alpha1.Target) map[string]string {
+	return map[string]string{
+		BACKUPSESSION_LABEL: r.Name,
+		BACKUPCONF_LABEL:    r.backupConf.Name,
+		TARGET_LABEL:        target.TargetName,
+	}
+}
+
+func (r *BackupSessionReconciler) snapshotVolume(target formolv1alpha1.Target, volume corev1.Volume) (*volumesnapshotv1.VolumeSnapshot, error) {
 	r.Log.V(0).Info("Preparing snapshot", "volume", volume.Name)
 	if volume.VolumeSource.PersistentVolumeClaim != nil {
 		pvc := corev1.PersistentVolumeClaim{}
@@ -146,58 +367,66 @@ func (r *BackupSessionReconciler) snapshotVolume(volume corev1.Volume) (*volumes
 		}
 		if pv.Spec.PersistentVolumeSource.CSI != nil {
 			// This volume is supported by a CSI driver. Let's see if we can snapshot it.
-			volumeSnapshotClassList := volumesnapshotv1.VolumeSnapshotClassList{}
-			if err := r.List(r.Context, &volumeSnapshotClassList); err != nil {
-				r.Log.Error(err, "unable to get VolumeSnapshotClass list")
+			volumeSnapshotClass, err := r.getVolumeSnapshotClass(target, pvc, pv.Spec.PersistentVolumeSource.CSI.Driver)
+			if err != nil {
 				return nil, err
 			}
-			for _, volumeSnapshotClass := range volumeSnapshotClassList.Items {
-				if volumeSnapshotClass.Driver == pv.Spec.PersistentVolumeSource.CSI.Driver {
-					// Check if a snapshot exist
-					volumeSnapshot := volumesnapshotv1.VolumeSnapshot{}
-					volumeSnapshotName := strings.Join([]string{"vs", r.Name, pv.Name}, "-")
+			if volumeSnapshotClass != nil {
+				// Check if a snapshot exist
+				volumeSnapshot := volumesnapshotv1.VolumeSnapshot{}
+				volumeSnapshotName := strings.Join([]string{"vs", r.Name, pv.Name}, "-")
 
-					if err := r.Get(r.Context, client.ObjectKey{
-						Namespace: r.Namespace,
-						Name:      volumeSnapshotName,
-					}, &volumeSnapshot); errors.IsNotFound(err) {
-						// No snapshot found. Create a new one.
-						// We want to snapshot using this VolumeSnapshotClass
-						r.Log.V(0).Info("Create a volume snapshot", "pvc", pvc.Name)
-						volumeSnapshot = volumesnapshotv1.VolumeSnapshot{
-							ObjectMeta: metav1.ObjectMeta{
-								Namespace: r.Namespace,
-								Name:      volumeSnapshotName,
-								Labels: map[string]string{
-									"backupsession": r.Name,
-								},
-							},
-							Spec: volumesnapshotv1.VolumeSnapshotSpec{
-								VolumeSnapshotClassName: &volumeSnapshotClass.Name,
-								Source: volumesnapshotv1.VolumeSnapshotSource{
-									PersistentVolumeClaimName: &pvc.Name,
-								},
+				if err := r.Get(r.Context, client.ObjectKey{
+					Namespace: r.Namespace,
+					Name:      volumeSnapshotName,
+				}, &volumeSnapshot); errors.IsNotFound(err) {
+					// No snapshot found. Create a new one.
+					// We want to snapshot using this VolumeSnapshotClass
+					r.Log.V(0).Info("Create a volume snapshot", "pvc", pvc.Name)
+					volumeSnapshot = volumesnapshotv1.VolumeSnapshot{
+						ObjectMeta: metav1.ObjectMeta{
+							Namespace: r.Namespace,
+							Name:      volumeSnapshotName,
+							Labels:    r.snapshotLabels(target),
+						},
+						Spec: volumesnapshotv1.VolumeSnapshotSpec{
+							VolumeSnapshotClassName: &volumeSnapshotClass.Name,
+							Source: volumesnapshotv1.VolumeSnapshotSource{
+								PersistentVolumeClaimName: &pvc.Name,
 							},
+						},
+					}
+					// The VolumeSnapshot goes away with the BackupSession
+					if err := controllerutil.SetControllerReference(&r.backupSession, &volumeSnapshot, r.Scheme); err != nil {
+						r.Log.Error(err, "unable to set the snapshot owner", "pvc", pvc.Name)
+						return nil, err
+					}
+					if err := r.Create(r.Context, &volumeSnapshot); err != nil {
+						r.Log.Error(err, "unable to create the snapshot", "pvc", pvc.Name)
+						return nil, err
+					}
+					// We just created the snapshot. We have to assume it's not yet ready and reschedule
+					return nil, &NotReadyToUseError{Since: time.Now(), Pending: true}
+				} else {
+					if err != nil {
+						r.Log.Error(err, "Something went very wrong here")
+						return nil, err
+					}
+					// The VolumeSnapshot exists. Is it ReadyToUse?
+					if volumeSnapshot.Status == nil || volumeSnapshot.Status.ReadyToUse == nil || *volumeSnapshot.Status.ReadyToUse == false {
+						r.Log.V(0).Info("Volume snapshot exists but it is not ready", "volume", volumeSnapshot.Name)
+						notReady := &NotReadyToUseError{
+							Since: volumeSnapshot.CreationTimestamp.Time,
+							// The snapshot is taken when the storage reports its creation time
+							Pending: volumeSnapshot.Status == nil || volumeSnapshot.Status.CreationTime == nil,
 						}
-						if err := r.Create(r.Context, &volumeSnapshot); err != nil {
-							r.Log.Error(err, "unable to create the snapshot", "pvc", pvc.Name)
-							return nil, err
-						}
-						// We just created the snapshot. We have to assume it's not yet ready and reschedule
-						return nil, &NotReadyToUseError{}
-					} else {
-						if err != nil {
-							r.Log.Error(err, "Something went very wrong here")
-							return nil, err
-						}
-						// The VolumeSnapshot exists. Is it ReadyToUse?
-						if volumeSnapshot.Status == nil || volumeSnapshot.Status.ReadyToUse == nil || *volumeSnapshot.Status.ReadyToUse == false {
-							r.Log.V(0).Info("Volume snapshot exists but it is not ready", "volume", volumeSnapshot.Name)
-							return nil, &NotReadyToUseError{}
+						if volumeSnapshot.Status != nil && volumeSnapshot.Status.Error != nil && volumeSnapshot.Status.Error.Message != nil {
+							notReady.Messages = append(notReady.Messages, volumeSnapshot.Name+": "+*volumeSnapshot.Status.Error.Message)
 						}
-						r.Log.V(0).Info("Volume snapshot is ready to use", "volume", volumeSnapshot.Name)
-						return &volumeSnapshot, nil
+						return nil, notReady
 					}
+					r.Log.V(0).Info("Volume snapshot is ready to use", "volume", volumeSnapshot.Name)
+					return &volumeSnapshot, nil
 				}
 			}
 		}
@@ -205,8 +434,81 @@ func (r *BackupSessionReconciler) snapshotVolume(volume corev1.Volume) (*volumes
 	return nil, nil
 }
 
-func (r *BackupSessionReconciler) createVolumeFromSnapshot(vs *volumesnapshotv1.VolumeSnapshot) (backupPVCName string, err error) {
-	backupPVCName = strings.Replace(vs.Name, "vs", "bak", 1)
+// Selects the VolumeSnapshotClass used to snapshot the PVC.
+// A class set explicitly has to exist and match the driver of the PVC.
+// In order:
+//   - the class set on the PVC with the volume-snapshot-class annotation
+//   - the class set on the target with the volume-snapshot-class option
+//   - the default class of the CSI driver
+//   - the only class of the CSI driver
+//
+// Returns nil if the driver has no VolumeSnapshotClass.
+func (r *BackupSessionReconciler) getVolumeSnapshotClass(target formolv1alpha1.Target, pvc corev1.PersistentVolumeClaim, driver string) (*volumesnapshotv1.VolumeSnapshotClass, error) {
+	volumeSnapshotClassList := volumesnapshotv1.VolumeSnapshotClassList{}
+	if err := r.List(r.Context, &volumeSnapshotClassList); err != nil {
+		r.Log.Error(err, "unable to get VolumeSnapshotClass list")
+		return nil, err
+	}
+	// The class set on the PVC takes precedence
+	className, found := pvc.Annotations[ANNOTATION_PREFIX+VOLUME_SNAPSHOT_CLASS_OPTION]
+	if !found {
+		className, found = getOption(&r.backupConf, VOLUME_SNAPSHOT_CLASS_OPTION, target.TargetName)
+	}
+	if found {
+		for i, volumeSnapshotClass := range volumeSnapshotClassList.Items {
+			if volumeSnapshotClass.Name != className {
+				continue
+			}
+			if volumeSnapshotClass.Driver != driver {
+				err := &InvalidSnapshotClassError{Class: className, PVC: pvc.Name,
+					Reason: fmt.Sprintf("it is for driver %s and not %s", volumeSnapshotClass.Driver, driver)}
+				r.Log.Error(err, "cannot use the VolumeSnapshotClass")
+				return nil, err
+			}
+			return r.checkVolumeSnapshotClass(&volumeSnapshotClassList.Items[i]), nil
+		}
+		err := &InvalidSnapshotClassError{Class: className, PVC: pvc.Name, Reason: "it does not exist"}
+		r.Log.Error(err, "cannot use the VolumeSnapshotClass")
+		return nil, err
+	}
+	candidates := []*volumesnapshotv1.VolumeSnapshotClass{}
+	defaults := []*volumesnapshotv1.VolumeSnapshotClass{}
+	for i, volumeSnapshotClass := range volumeSnapshotClassList.Items {
+		if volumeSnapshotClass.Driver != driver {
+			continue
+		}
+		candidates = append(candidates, &volumeSnapshotClassList.Items[i])
+		if volumeSnapshotClass.Annotations[DEFAULT_SNAPSHOT_CLASS_ANNOTATION] == "true" {
+			defaults = append(defaults, &volumeSnapshotClassList.Items[i])
+		}
+	}
+	switch {
+	case len(defaults) == 1:
+		return r.checkVolumeSnapshotClass(defaults[0]), nil
+	case len(defaults) > 1:
+		err := fmt.Errorf("%d default VolumeSnapshotClasses for driver %s", len(defaults), driver)
+		r.Log.Error(err, "cannot select the VolumeSnapshotClass. Set the volume-snapshot-class option", "pvc", pvc.Name)
+		return nil, err
+	case len(candidates) == 1:
+		return r.checkVolumeSnapshotClass(candidates[0]), nil
+	case len(candidates) > 1:
+		err := fmt.Errorf("%d VolumeSnapshotClasses and no default one for driver %s", len(candidates), driver)
+		r.Log.Error(err, "cannot select the VolumeSnapshotClass. Set the volume-snapshot-class option", "pvc", pvc.Name)
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (r *BackupSessionReconciler) checkVolumeSnapshotClass(volumeSnapshotClass *volumesnapshotv1.VolumeSnapshotClass) *volumesnapshotv1.VolumeSnapshotClass {
+	if volumeSnapshotClass.DeletionPolicy == volumesnapshotv1.VolumeSnapshotContentRetain {
+		r.Log.V(0).Info("The VolumeSnapshotClass retains the snapshots. They will be left behind in the storage backend", "class", volumeSnapshotClass.Name)
+	}
+	return volumeSnapshotClass
+}
+
+// Creates a PVC from the snapshot of the PV
+func (r *BackupSessionReconciler) createVolumeFromSnapshot(target formolv1alpha1.Target, vs *volumesnapshotv1.VolumeSnapshot, pvName string) (backupPVCName string, err error) {
+	backupPVCName = strings.Join([]string{"bak", r.Name, pvName}, "-")
 	backupPVC := corev1.PersistentVolumeClaim{}
 	if err = r.Get(r.Context, client.ObjectKey{
 		Namespace: r.Namespace,
@@ -214,8 +516,6 @@ func (r *BackupSessionReconciler) createVolumeFromSnapshot(vs *volumesnapshotv1.
 	}, &backupPVC); errors.IsNotFound(err) {
 		// The Volume does not exist. Create it.
 		pv := corev1.PersistentVolume{}
-		pvName, _ := strings.CutPrefix(vs.Name, strings.Join([]string{"vs", r.Name}, "-"))
-		pvName = pvName[1:]
 		if err = r.Get(r.Context, client.ObjectKey{
 			Name: pvName,
 		}, &pv); err != nil {
@@ -226,12 +526,12 @@ func (r *BackupSessionReconciler) createVolumeFromSnapshot(vs *volumesnapshotv1.
 			ObjectMeta: metav1.ObjectMeta{
 				Namespace: r.Namespace,
 				Name:      backupPVCName,
-				Labels: map[string]string{
-					"backupsession": r.Name,
-				},
+				Labels:    r.snapshotLabels(target),
 			},
 			Spec: corev1.PersistentVolumeClaimSpec{
 				StorageClassName: &pv.Spec.StorageClassName,
+				// The snapshot of a raw block volume has to be restored as a block volume
+				VolumeMode: pv.Spec.VolumeMode,
 				//AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadOnlyMany},
 				AccessModes: pv.Spec.AccessModes,
 				Resources: corev1.ResourceRequirements{
@@ -244,6 +544,11 @@ func (r *BackupSessionReconciler) createVolumeFromSnapshot(vs *volumesnapshotv1.
 				},
 			},
 		}
+		// The PVC goes away with the BackupSession
+		if err = controllerutil.SetControllerReference(&r.backupSession, &backupPVC, r.Scheme); err != nil {
+			r.Log.Error(err, "unable to set the backup PVC owner", "backupPVC", backupPVC.Name)
+			return
+		}
 		if err = r.Create(r.Context, &backupPVC); err != nil {
 			r.Log.Error(err, "unable to create backup PVC", "backupPVC", backupPVC)
 			return
@@ -255,17 +560,87 @@ func (r *BackupSessionReconciler) createVolumeFromSnapshot(vs *volumesnapshotv1.
 	return
 }
 
-func (r *BackupSessionReconciler) snapshotVolumes(vms []corev1.VolumeMount, podSpec *corev1.PodSpec) (err error) {
+// Gets the name of the PV of the snapshot. It is part of the snapshot name: vs-<session>-<pv>.
+// Otherwise the PV is found from the PVC source of the snapshot.
+func (r *BackupSessionReconciler) snapshotPVName(vs *volumesnapshotv1.VolumeSnapshot) (string, error) {
+	prefix := strings.Join([]string{"vs", r.Name, ""}, "-")
+	if strings.HasPrefix(vs.Name, prefix) && len(vs.Name) > len(prefix) {
+		return strings.TrimPrefix(vs.Name, prefix), nil
+	}
+	if vs.Spec.Source.PersistentVolumeClaimName == nil {
+		err := fmt.Errorf("volumesnapshot %s has no pvc source", vs.Name)
+		r.Log.Error(err, "unable to find the pv of the snapshot")
+		return "", err
+	}
+	pvc := corev1.PersistentVolumeClaim{}
+	if err := r.Get(r.Context, client.ObjectKey{
+		Namespace: vs.Namespace,
+		Name:      *vs.Spec.Source.PersistentVolumeClaimName,
+	}, &pvc); err != nil {
+		r.Log.Error(err, "unable to get the pvc of the snapshot", "vs", vs.Name)
+		return "", err
+	}
+	if pvc.Spec.VolumeName == "" {
+		err := fmt.Errorf("pvc %s is not bound", pvc.Name)
+		r.Log.Error(err, "unable to find the pv of the snapshot", "vs", vs.Name)
+		return "", err
+	}
+	return pvc.Spec.VolumeName, nil
+}
+
+// Returns true if the data of the volume only lives on the node of the Pod
+func isPodLocalVolume(podSpec *corev1.PodSpec, name string) bool {
+	for _, volume := range podSpec.Volumes {
+		if volume.Name == name {
+			return volume.VolumeSource.EmptyDir != nil || volume.VolumeSource.HostPath != nil
+		}
+	}
+	return false
+}
+
+func (r *BackupSessionReconciler) snapshotVolumes(target formolv1alpha1.Target, names []string, podSpec *corev1.PodSpec, notes map[string]string) (skipped []string, err error) {
+	if getBoolOption(&r.backupConf, GROUP_SNAPSHOT_OPTION, target.TargetName) {
+		// Snapshot all the volumes at once if the driver supports it
+		var group groupSnapshotSource
+		if group, err = r.getGroupSnapshotSource(target, names, podSpec); err != nil {
+			return nil, err
+		}
+		if group.reason == "" {
+			notes[SNAPSHOT_MODE_NOTE] = GROUP_SNAPSHOT_MODE
+			return nil, r.groupSnapshotVolumes(target, group, podSpec)
+		}
+		r.Log.V(0).Info("Cannot snapshot the volumes as a group. Snapshotting them one by one", "reason", group.reason)
+		notes[SNAPSHOT_MODE_NOTE] = PER_VOLUME_SNAPSHOT_MODE + ": " + group.reason
+		// The snapshots are only consistent with each other if the target is quiesced
+		if err := r.quiesceTarget(target, notes); err != nil {
+			return nil, err
+		}
+		defer func() {
+			// Unquiesce once all the snapshots are taken or when giving up
+			if notReady, ok := err.(*NotReadyToUseError); ok && notReady.Pending {
+				return
+			}
+			if unquiesceErr := r.unquiesceTarget(target, notes); err == nil {
+				err = unquiesceErr
+			}
+		}()
+	} else {
+		notes[SNAPSHOT_MODE_NOTE] = PER_VOLUME_SNAPSHOT_MODE
+	}
 	// We snapshot/check all the volumes. If at least one of the snapshot is not ready to use. We reschedule.
-	for _, vm := range vms {
+	var notReady *NotReadyToUseError
+	// The volumes that are not CSI PVCs or have no VolumeSnapshotClass
+	unsnapshottable := []string{}
+	for _, name := range names {
 		for i, volume := range podSpec.Volumes {
-			if vm.Name == volume.Name {
+			if name == volume.Name {
 				var vs *volumesnapshotv1.VolumeSnapshot
-				vs, err = r.snapshotVolume(volume)
+				vs, err = r.snapshotVolume(target, volume)
 				if IsNotReadyToUse(err) {
-					defer func() {
-						err = &NotReadyToUseError{}
-					}()
+					if notReady == nil {
+						notReady = &NotReadyToUseError{}
+					}
+					notReady.merge(err.(*NotReadyToUseError))
 					continue
 				}
 				if err != nil {
@@ -273,19 +648,65 @@ func (r *BackupSessionReconciler) snapshotVolumes(vms []corev1.VolumeMount, podS
 				}
 				if vs != nil {
 					// The snapshot is ready. We create a PVC from it.
-					backupPVCName, err := r.createVolumeFromSnapshot(vs)
+					pvName, err := r.snapshotPVName(vs)
+					if err != nil {
+						return nil, err
+					}
+					backupPVCName, err := r.createVolumeFromSnapshot(target, vs, pvName)
 					if err != nil {
 						r.Log.Error(err, "unable to create volume from snapshot", "vs", vs)
-						return err
+						return nil, err
 					}
 					podSpec.Volumes[i].VolumeSource.PersistentVolumeClaim = &corev1.PersistentVolumeClaimVolumeSource{
 						ClaimName: backupPVCName,
 						ReadOnly:  true,
 					}
 					// The snapshot and the volume will be deleted by the Job when the backup is over
+				} else {
+					unsnapshottable = append(unsnapshottable, volume.Name)
 				}
 			}
 		}
 	}
+	if len(unsnapshottable) > 0 {
+		policy, found := getOption(&r.backupConf, UNSNAPSHOTTABLE_VOLUMES_OPTION, target.TargetName)
+		switch policy {
+		case FAIL_POLICY:
+			return nil, &NotSnapshottableError{Volumes: unsnapshottable}
+		case SKIP_POLICY:
+			r.Log.V(0).Info("Some volumes cannot be snapshotted. They are not backed up", "volumes", unsnapshottable)
+			skipped = unsnapshottable
+			notes[UNSNAPSHOTTABLE_VOLUMES_NOTE] = SKIP_POLICY + ": " + strings.Join(unsnapshottable, ",")
+		default:
+			// The emptyDir and hostPath volumes of the backup Job are not the ones of the running Pod
+			live, local := []string{}, []string{}
+			for _, name := range unsnapshottable {
+				if isPodLocalVolume(podSpec, name) {
+					local = append(local, name)
+				} else {
+					live = append(live, name)
+				}
+			}
+			if len(local) > 0 && found {
+				err = &NotSnapshottableError{Volumes: local}
+				r.Log.Error(err, "The emptyDir and hostPath volumes cannot be backed up live from the backup Job")
+				return nil, err
+			}
+			reports := []string{}
+			if len(live) > 0 {
+				r.Log.V(0).Info("WARNING: some volumes cannot be snapshotted. They are backed up live", "volumes", live)
+				reports = append(reports, LIVE_POLICY+": "+strings.Join(live, ","))
+			}
+			if len(local) > 0 {
+				r.Log.V(0).Info("WARNING: the emptyDir and hostPath volumes cannot be backed up by the backup Job. They are not backed up", "volumes", local)
+				skipped = local
+				reports = append(reports, SKIP_POLICY+": "+strings.Join(local, ","))
+			}
+			notes[UNSNAPSHOTTABLE_VOLUMES_NOTE] = strings.Join(reports, "; ")
+		}
+	}
+	if notReady != nil {
+		return nil, notReady
+	}
 	return
 }
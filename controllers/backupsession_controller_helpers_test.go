@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestJobName(t *testing.T) {
+	long := strings.Join([]string{"backupsnapshot", "backupsession-postgresql-backup-configuration-1681300000", "postgresql-primary"}, "-")
+	tests := []struct {
+		name  string
+		parts []string
+		want  string
+	}{
+		{name: "short name", parts: []string{"backupsnapshot", "backupsession-demo-1681300000", "web"}, want: "backupsnapshot-backupsession-demo-1681300000-web"},
+		{name: "long name", parts: []string{long}},
+		{name: "truncated on a dash", parts: []string{"restore", strings.Repeat("a", 45), strings.Repeat("b", 20)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := jobName(tt.parts...)
+			if tt.want != "" && got != tt.want {
+				t.Errorf("jobName() = %q, want %q", got, tt.want)
+			}
+			if errs := validation.IsValidLabelValue(got); len(errs) > 0 {
+				t.Errorf("jobName() = %q is not a valid label value: %v", got, errs)
+			}
+			if strings.Contains(got, "--") {
+				t.Errorf("jobName() = %q, want no empty part", got)
+			}
+			if errs := validation.IsDNS1123Label(got); len(errs) > 0 {
+				t.Errorf("jobName() = %q is not a valid name: %v", got, errs)
+			}
+		})
+	}
+	// The hash keeps the names of different targets apart
+	if jobName(long+"-a") == jobName(long+"-b") {
+		t.Errorf("jobName() gives the same name to different Jobs: %q", jobName(long+"-a"))
+	}
+}
+
+func snapshotClass(name string, driver string, isDefault bool) *volumesnapshotv1.VolumeSnapshotClass {
+	class := &volumesnapshotv1.VolumeSnapshotClass{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Driver:     driver,
+	}
+	if isDefault {
+		class.Annotations = map[string]string{DEFAULT_SNAPSHOT_CLASS_ANNOTATION: "true"}
+	}
+	return class
+}
+
+func TestGetVolumeSnapshotClass(t *testing.T) {
+	const driver = "csi.example.com"
+	tests := []struct {
+		name           string
+		classes        []client.Object
+		pvcAnnotations map[string]string
+		confOption     string
+		want           string
+		wantErr        bool
+	}{
+		{
+			name:    "only class of the driver",
+			classes: []client.Object{snapshotClass("fast", driver, false), snapshotClass("other", "other.example.com", true)},
+			want:    "fast",
+		},
+		{
+			name:    "default class of the driver",
+			classes: []client.Object{snapshotClass("fast", driver, false), snapshotClass("safe", driver, true)},
+			want:    "safe",
+		},
+		{
+			name:    "several default classes",
+			classes: []client.Object{snapshotClass("fast", driver, true), snapshotClass("safe", driver, true)},
+			wantErr: true,
+		},
+		{
+			name:    "several classes and no default one",
+			classes: []client.Object{snapshotClass("fast", driver, false), snapshotClass("safe", driver, false)},
+			wantErr: true,
+		},
+		{
+			name:       "class of the target",
+			classes:    []client.Object{snapshotClass("fast", driver, false), snapshotClass("safe", driver, true)},
+			confOption: "fast",
+			want:       "fast",
+		},
+		{
+			name:           "the class of the pvc takes precedence",
+			classes:        []client.Object{snapshotClass("fast", driver, false), snapshotClass("safe", driver, true)},
+			pvcAnnotations: map[string]string{ANNOTATION_PREFIX + VOLUME_SNAPSHOT_CLASS_OPTION: "safe"},
+			confOption:     "fast",
+			want:           "safe",
+		},
+		{
+			name:       "class of another driver",
+			classes:    []client.Object{snapshotClass("fast", driver, false), snapshotClass("other", "other.example.com", false)},
+			confOption: "other",
+			wantErr:    true,
+		},
+		{
+			name:       "missing class",
+			classes:    []client.Object{snapshotClass("fast", driver, false)},
+			confOption: "missing",
+			wantErr:    true,
+		},
+		{
+			name:    "no class for the driver",
+			classes: []client.Object{snapshotClass("other", "other.example.com", true)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &BackupSessionReconciler{Session: fakeClientSession(tt.classes...)}
+			if tt.confOption != "" {
+				r.backupConf.Annotations = map[string]string{ANNOTATION_PREFIX + VOLUME_SNAPSHOT_CLASS_OPTION + ".web": tt.confOption}
+			}
+			pvc := corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data", Annotations: tt.pvcAnnotations}}
+			got, err := r.getVolumeSnapshotClass(formolv1alpha1.Target{TargetName: "web"}, pvc, driver)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("getVolumeSnapshotClass() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getVolumeSnapshotClass() failed: %v", err)
+			}
+			name := ""
+			if got != nil {
+				name = got.Name
+			}
+			if name != tt.want {
+				t.Errorf("getVolumeSnapshotClass() = %q, want %q", name, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotVolumesUnsnapshottable(t *testing.T) {
+	// An NFS volume cannot be snapshotted but can be backed up live. An emptyDir cannot.
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nfs"},
+		Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-nfs"},
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-nfs"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{NFS: &corev1.NFSVolumeSource{Server: "nfs", Path: "/"}},
+		},
+	}
+	tests := []struct {
+		name        string
+		policy      string
+		wantSkipped []string
+		wantNote    string
+		wantErr     []string
+	}{
+		{name: "default", policy: "", wantSkipped: []string{"cache"}, wantNote: LIVE_POLICY + ": nfs; " + SKIP_POLICY + ": cache"},
+		{name: "live", policy: LIVE_POLICY, wantErr: []string{"cache"}},
+		{name: "skip", policy: SKIP_POLICY, wantSkipped: []string{"nfs", "cache"}, wantNote: SKIP_POLICY + ": nfs,cache"},
+		{name: "fail", policy: FAIL_POLICY, wantErr: []string{"nfs", "cache"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &BackupSessionReconciler{Session: fakeClientSession(pvc, pv)}
+			if tt.policy != "" {
+				r.backupConf.Annotations = map[string]string{ANNOTATION_PREFIX + UNSNAPSHOTTABLE_VOLUMES_OPTION: tt.policy}
+			}
+			podSpec := &corev1.PodSpec{Volumes: []corev1.Volume{
+				{Name: "nfs", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "nfs"}}},
+				{Name: "cache", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			}}
+			notes := make(map[string]string)
+			skipped, err := r.snapshotVolumes(formolv1alpha1.Target{TargetName: "web"}, []string{"nfs", "cache"}, podSpec, notes)
+			if tt.wantErr != nil {
+				notSnapshottable, ok := err.(*NotSnapshottableError)
+				if !ok || !reflect.DeepEqual(notSnapshottable.Volumes, tt.wantErr) {
+					t.Fatalf("snapshotVolumes() error = %v, want the volumes %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("snapshotVolumes() failed: %v", err)
+			}
+			if !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("snapshotVolumes() skipped = %v, want %v", skipped, tt.wantSkipped)
+			}
+			if note := notes[UNSNAPSHOTTABLE_VOLUMES_NOTE]; note != tt.wantNote {
+				t.Errorf("snapshotVolumes() note = %q, want %q", note, tt.wantNote)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package controllers
+
+import (
+	"fmt"
+	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strings"
+	"time"
+)
+
+const (
+	// Note telling how the volumes of the target were snapshotted
+	SNAPSHOT_MODE_NOTE       = "snapshot-mode"
+	GROUP_SNAPSHOT_MODE      = "group"
+	PER_VOLUME_SNAPSHOT_MODE = "per-volume"
+	// Labels of the target PVCs selected by the VolumeGroupSnapshot
+	GROUP_SNAPSHOT_LABEL        = ANNOTATION_PREFIX + "group-snapshot"
+	GROUP_SNAPSHOT_TARGET_LABEL = ANNOTATION_PREFIX + "group-snapshot-target"
+	// The default VolumeGroupSnapshotClass of a CSI driver has this annotation set to "true"
+	DEFAULT_GROUP_SNAPSHOT_CLASS_ANNOTATION = "groupsnapshot.storage.kubernetes.io/is-default-class"
+)
+
+const (
+	GROUP_SNAPSHOT_GROUP = "groupsnapshot.storage.k8s.io"
+	// Note telling whether the target was quiesced before the per-volume snapshots
+	QUIESCE_NOTE = "quiesce"
+	QUIESCED     = "quiesced"
+	UNQUIESCED   = "unquiesced"
+	NOT_QUIESCED = "none"
+)
+
+// The VolumeGroupSnapshot API is not part of the snapshotter client.
+// These are the versions we know the status of.
+var groupSnapshotVersions = []string{"v1alpha1"}
+
+// Finds a served version of the VolumeGroupSnapshot API we support.
+// Returns why the API cannot be used otherwise.
+func (s Session) getGroupSnapshotGV() (gv schema.GroupVersion, reason string, err error) {
+	mappings, err := s.RESTMapper().RESTMappings(schema.GroupKind{Group: GROUP_SNAPSHOT_GROUP, Kind: "VolumeGroupSnapshot"})
+	if err != nil {
+		if meta.IsNoMatchError(err) {
+			return gv, "the VolumeGroupSnapshot API is not available", nil
+		}
+		s.Log.Error(err, "unable to discover the VolumeGroupSnapshot API")
+		return
+	}
+	served := []string{}
+	for _, mapping := range mappings {
+		for _, version := range groupSnapshotVersions {
+			if mapping.GroupVersionKind.Version == version {
+				return mapping.GroupVersionKind.GroupVersion(), "", nil
+			}
+		}
+		served = append(served, mapping.GroupVersionKind.Version)
+	}
+	return gv, fmt.Sprintf("unsupported VolumeGroupSnapshot API version %s", strings.Join(served, ",")), nil
+}
+
+// The target volumes snapshotted by a VolumeGroupSnapshot
+type groupSnapshotSource struct {
+	gv        schema.GroupVersion
+	className string
+	// PV name of the target PVCs
+	pvNames map[string]string
+	// Why the volumes cannot be snapshotted as a group
+	reason string
+}
+
+// Checks that all the target volumes are CSI volumes of a driver with a VolumeGroupSnapshotClass
+func (r *BackupSessionReconciler) getGroupSnapshotSource(target formolv1alpha1.Target, names []string, podSpec *corev1.PodSpec) (group groupSnapshotSource, err error) {
+	group.pvNames = make(map[string]string)
+	driver := ""
+	for _, name := range names {
+		for _, volume := range podSpec.Volumes {
+			if name != volume.Name {
+				continue
+			}
+			if volume.VolumeSource.PersistentVolumeClaim == nil {
+				group.reason = fmt.Sprintf("volume %s is not a PVC", volume.Name)
+				return
+			}
+			claimName := volume.VolumeSource.PersistentVolumeClaim.ClaimName
+			if _, found := group.pvNames[claimName]; found {
+				continue
+			}
+			pvc := corev1.PersistentVolumeClaim{}
+			if err = r.Get(r.Context, client.ObjectKey{
+				Namespace: r.Namespace,
+				Name:      claimName,
+			}, &pvc); err != nil {
+				r.Log.Error(err, "unable to get pvc", "volume", volume)
+				return
+			}
+			pv := corev1.PersistentVolume{}
+			if err = r.Get(r.Context, client.ObjectKey{
+				Name: pvc.Spec.VolumeName,
+			}, &pv); err != nil {
+				r.Log.Error(err, "unable to get pv", "volume", pvc.Spec.VolumeName)
+				return
+			}
+			if pv.Spec.PersistentVolumeSource.CSI == nil {
+				group.reason = fmt.Sprintf("pvc %s is not a CSI volume", claimName)
+				return
+			}
+			if driver != "" && driver != pv.Spec.PersistentVolumeSource.CSI.Driver {
+				group.reason = fmt.Sprintf("the volumes use the %s and %s drivers", driver, pv.Spec.PersistentVolumeSource.CSI.Driver)
+				return
+			}
+			driver = pv.Spec.PersistentVolumeSource.CSI.Driver
+			group.pvNames[claimName] = pv.Name
+		}
+	}
+	if len(group.pvNames) == 0 {
+		group.reason = "no volume to snapshot"
+		return
+	}
+	if group.gv, group.reason, err = r.getGroupSnapshotGV(); err != nil || group.reason != "" {
+		return
+	}
+	classes := unstructured.UnstructuredList{}
+	classes.SetGroupVersionKind(group.gv.WithKind("VolumeGroupSnapshotClassList"))
+	if err = r.List(r.Context, &classes); err != nil {
+		r.Log.Error(err, "unable to get VolumeGroupSnapshotClass list")
+		return
+	}
+	candidates := []string{}
+	defaults := []string{}
+	for _, class := range classes.Items {
+		if classDriver, _, _ := unstructured.NestedString(class.Object, "driver"); classDriver != driver {
+			continue
+		}
+		candidates = append(candidates, class.GetName())
+		if class.GetAnnotations()[DEFAULT_GROUP_SNAPSHOT_CLASS_ANNOTATION] == "true" {
+			defaults = append(defaults, class.GetName())
+		}
+	}
+	switch {
+	case len(defaults) == 1:
+		group.className = defaults[0]
+	case len(defaults) == 0 && len(candidates) == 1:
+		group.className = candidates[0]
+	case len(candidates) == 0:
+		group.reason = fmt.Sprintf("no VolumeGroupSnapshotClass for driver %s", driver)
+	default:
+		group.reason = fmt.Sprintf("cannot select a VolumeGroupSnapshotClass for driver %s", driver)
+	}
+	return
+}
+
+// Snapshots all the target volumes at once and replaces them in the Pod spec with volumes created from the snapshots
+func (r *BackupSessionReconciler) groupSnapshotVolumes(target formolv1alpha1.Target, group groupSnapshotSource, podSpec *corev1.PodSpec) error {
+	groupSnapshot := unstructured.Unstructured{}
+	groupSnapshot.SetGroupVersionKind(group.gv.WithKind("VolumeGroupSnapshot"))
+	groupSnapshotName := strings.Join([]string{"vgs", r.Name, target.TargetName}, "-")
+	if err := r.Get(r.Context, client.ObjectKey{
+		Namespace: r.Namespace,
+		Name:      groupSnapshotName,
+	}, &groupSnapshot); errors.IsNotFound(err) {
+		// The VolumeGroupSnapshot selects the PVCs by label
+		selector := map[string]string{
+			GROUP_SNAPSHOT_LABEL:        r.Name,
+			GROUP_SNAPSHOT_TARGET_LABEL: target.TargetName,
+		}
+		for claimName := range group.pvNames {
+			pvc := corev1.PersistentVolumeClaim{}
+			if err := r.Get(r.Context, client.ObjectKey{
+				Namespace: r.Namespace,
+				Name:      claimName,
+			}, &pvc); err != nil {
+				r.Log.Error(err, "unable to get pvc", "pvc", claimName)
+				return err
+			}
+			patch := client.MergeFrom(pvc.DeepCopy())
+			if pvc.Labels == nil {
+				pvc.Labels = make(map[string]string)
+			}
+			for key, value := range selector {
+				pvc.Labels[key] = value
+			}
+			if err := r.Patch(r.Context, &pvc, patch); err != nil {
+				r.Log.Error(err, "unable to label the pvc", "pvc", claimName)
+				return err
+			}
+		}
+		r.Log.V(0).Info("Create a volume group snapshot", "target", target.TargetName)
+		groupSnapshot.SetNamespace(r.Namespace)
+		groupSnapshot.SetName(groupSnapshotName)
+		groupSnapshot.SetLabels(r.snapshotLabels(target))
+		groupSnapshot.Object["spec"] = map[string]interface{}{
+			"volumeGroupSnapshotClassName": group.className,
+			"source": map[string]interface{}{
+				"selector": map[string]interface{}{
+					"matchLabels": map[string]interface{}{
+						GROUP_SNAPSHOT_LABEL:        r.Name,
+						GROUP_SNAPSHOT_TARGET_LABEL: target.TargetName,
+					},
+				},
+			},
+		}
+		// The VolumeGroupSnapshot and its VolumeSnapshots go away with the BackupSession
+		if err := controllerutil.SetControllerReference(&r.backupSession, &groupSnapshot, r.Scheme); err != nil {
+			r.Log.Error(err, "unable to set the group snapshot owner", "target", target.TargetName)
+			return err
+		}
+		if err := r.Create(r.Context, &groupSnapshot); err != nil {
+			r.Log.Error(err, "unable to create the group snapshot", "target", target.TargetName)
+			return err
+		}
+		return &NotReadyToUseError{Since: time.Now()}
+	} else if err != nil {
+		r.Log.Error(err, "unable to get the group snapshot", "name", groupSnapshotName)
+		return err
+	}
+	if ready, _, _ := unstructured.NestedBool(groupSnapshot.Object, "status", "readyToUse"); !ready {
+		r.Log.V(0).Info("Volume group snapshot exists but it is not ready", "name", groupSnapshotName)
+		notReady := &NotReadyToUseError{Since: groupSnapshot.GetCreationTimestamp().Time}
+		if message, found, _ := unstructured.NestedString(groupSnapshot.Object, "status", "error", "message"); found {
+			notReady.Messages = append(notReady.Messages, groupSnapshotName+": "+message)
+		}
+		return notReady
+	}
+	// The VolumeSnapshots of the PVCs are created by the snapshot controller
+	refs, _, _ := unstructured.NestedSlice(groupSnapshot.Object, "status", "pvcVolumeSnapshotRefList")
+	snapshotNames := make(map[string]string)
+	for _, ref := range refs {
+		if pair, ok := ref.(map[string]interface{}); ok {
+			claimName, _, _ := unstructured.NestedString(pair, "persistentVolumeClaimRef", "name")
+			snapshotName, _, _ := unstructured.NestedString(pair, "volumeSnapshotRef", "name")
+			snapshotNames[claimName] = snapshotName
+		}
+	}
+	for i, volume := range podSpec.Volumes {
+		if volume.VolumeSource.PersistentVolumeClaim == nil {
+			continue
+		}
+		claimName := volume.VolumeSource.PersistentVolumeClaim.ClaimName
+		pvName, found := group.pvNames[claimName]
+		if !found {
+			continue
+		}
+		snapshotName, found := snapshotNames[claimName]
+		if !found {
+			err := fmt.Errorf("no volume snapshot of pvc %s in group snapshot %s", claimName, groupSnapshotName)
+			r.Log.Error(err, "incomplete group snapshot")
+			return err
+		}
+		vs := volumesnapshotv1.VolumeSnapshot{}
+		if err := r.Get(r.Context, client.ObjectKey{
+			Namespace: r.Namespace,
+			Name:      snapshotName,
+		}, &vs); err != nil {
+			r.Log.Error(err, "unable to get the volume snapshot", "vs", snapshotName)
+			return err
+		}
+		backupPVCName, err := r.createVolumeFromSnapshot(target, &vs, pvName)
+		if err != nil {
+			r.Log.Error(err, "unable to create volume from snapshot", "vs", vs.Name)
+			return err
+		}
+		podSpec.Volumes[i].VolumeSource.PersistentVolumeClaim = &corev1.PersistentVolumeClaimVolumeSource{
+			ClaimName: backupPVCName,
+			ReadOnly:  true,
+		}
+	}
+	return nil
+}
+
+// Deletes the VolumeGroupSnapshots, and their VolumeSnapshots, matching the labels
+func (s Session) deleteGroupSnapshots(namespace string, labels client.MatchingLabels) error {
+	gv, reason, err := s.getGroupSnapshotGV()
+	if err != nil || reason != "" {
+		// No VolumeGroupSnapshot to delete
+		return err
+	}
+	groupSnapshots := unstructured.UnstructuredList{}
+	groupSnapshots.SetGroupVersionKind(gv.WithKind("VolumeGroupSnapshotList"))
+	if err := s.List(s.Context, &groupSnapshots, client.InNamespace(namespace), labels); err != nil {
+		s.Log.Error(err, "unable to list the volumegroupsnapshots", "labels", labels)
+		return err
+	}
+	for _, groupSnapshot := range groupSnapshots.Items {
+		if err := s.Delete(s.Context, &groupSnapshot); err != nil && !errors.IsNotFound(err) {
+			s.Log.Error(err, "unable to delete volumegroupsnapshot", "name", groupSnapshot.GetName())
+			return err
+		}
+		s.Log.V(0).Info("volumegroupsnapshot deleted", "name", groupSnapshot.GetName())
+	}
+	return nil
+}
+
+// Removes the labels selecting the target PVCs for the VolumeGroupSnapshot
+func (r *BackupSessionReconciler) removeGroupSnapshotLabels(targetName string) error {
+	pvcs := corev1.PersistentVolumeClaimList{}
+	if err := r.List(r.Context, &pvcs, client.InNamespace(r.Namespace), client.MatchingLabels{
+		GROUP_SNAPSHOT_LABEL:        r.Name,
+		GROUP_SNAPSHOT_TARGET_LABEL: targetName,
+	}); err != nil {
+		r.Log.Error(err, "unable to list the group snapshot PVCs", "target", targetName)
+		return err
+	}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		patch := client.MergeFrom(pvc.DeepCopy())
+		delete(pvc.Labels, GROUP_SNAPSHOT_LABEL)
+		delete(pvc.Labels, GROUP_SNAPSHOT_TARGET_LABEL)
+		if err := r.Patch(r.Context, pvc, patch); err != nil {
+			r.Log.Error(err, "unable to remove the group snapshot labels", "pvc", pvc.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs the quiesce Function of the target before the volumes are snapshotted one by one.
+// The target is only quiesced once even if the snapshots take several reconciles.
+func (r *BackupSessionReconciler) quiesceTarget(target formolv1alpha1.Target, notes map[string]string) error {
+	if state := GetStatusNote(&r.backupSession, target.TargetName, QUIESCE_NOTE); state != "" {
+		notes[QUIESCE_NOTE] = state
+		return nil
+	}
+	name, found := getOption(&r.backupConf, QUIESCE_OPTION, target.TargetName)
+	if !found {
+		r.Log.V(0).Info("WARNING: no quiesce Function. The volumes are snapshotted one by one without quiescing the target")
+		notes[QUIESCE_NOTE] = NOT_QUIESCED
+		return nil
+	}
+	r.Log.V(0).Info("Quiescing the target before snapshotting the volumes", "Function", name)
+	if err := r.runFunction(name, r.quiesceVars(target)); err != nil {
+		r.Log.Error(err, "unable to quiesce the target", "Function", name)
+		return err
+	}
+	notes[QUIESCE_NOTE] = QUIESCED
+	return nil
+}
+
+// Runs the unquiesce Function of the target if the target was quiesced
+func (r *BackupSessionReconciler) unquiesceTarget(target formolv1alpha1.Target, notes map[string]string) error {
+	state, found := notes[QUIESCE_NOTE]
+	if !found {
+		state = GetStatusNote(&r.backupSession, target.TargetName, QUIESCE_NOTE)
+	}
+	if state != QUIESCED {
+		return nil
+	}
+	if name, found := getOption(&r.backupConf, UNQUIESCE_OPTION, target.TargetName); found {
+		r.Log.V(0).Info("Unquiescing the target", "Function", name)
+		if err := r.runFunction(name, r.quiesceVars(target)); err != nil {
+			r.Log.Error(err, "unable to unquiesce the target", "Function", name)
+			return err
+		}
+	}
+	notes[QUIESCE_NOTE] = UNQUIESCED
+	return nil
+}
+
+// The context variables of the quiesce Functions
+func (r *BackupSessionReconciler) quiesceVars(target formolv1alpha1.Target) map[string]string {
+	container := formolv1alpha1.TargetContainer{}
+	if len(target.Containers) > 0 {
+		container = target.Containers[0]
+	}
+	return r.getContextVars(container, BACKUP_PHASE)
+}
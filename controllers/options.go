@@ -0,0 +1,349 @@
+package controllers
+
+import (
+	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
+	"io/fs"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The formol options are set with annotations.
+// formol.desmojim.fr/<option>.<target> sets the option for a given target
+// formol.desmojim.fr/<option> sets the option for all the targets
+const (
+	ANNOTATION_PREFIX = "formol.desmojim.fr/"
+	// Comma separated list of patterns excluded from the backup
+	EXCLUDE_OPTION = "exclude"
+	// Comma separated list of file names. Directories containing one of them are excluded
+	EXCLUDE_IF_PRESENT_OPTION = "exclude-if-present"
+	// Exclude the directories containing a CACHEDIR.TAG file
+	EXCLUDE_CACHES_OPTION = "exclude-caches"
+	// Do not cross the filesystem boundaries
+	ONE_FILE_SYSTEM_OPTION = "one-file-system"
+	// Exclude the files larger than the given size (ie 100M)
+	EXCLUDE_LARGER_THAN_OPTION = "exclude-larger-than"
+	// The restic host of the target snapshots. Defaults to <namespace>-<target>
+	HOST_OPTION = "host"
+	// The VolumeSnapshotClass used to snapshot the target volumes.
+	// This option can also be set on a PVC.
+	VOLUME_SNAPSHOT_CLASS_OPTION = "volume-snapshot-class"
+	// How long to wait for the VolumeSnapshots to be ready to use (ie 10m)
+	SNAPSHOT_READY_TIMEOUT_OPTION = "snapshot-ready-timeout"
+	// restic upload and download limits in KiB/s.
+	// These options can also be set on the Repo.
+	LIMIT_UPLOAD_OPTION   = "limit-upload"
+	LIMIT_DOWNLOAD_OPTION = "limit-download"
+	// nice value and ionice class (1: realtime, 2: best-effort, 3: idle) and level (0-7) of restic.
+	// These options can also be set on the Repo.
+	NICE_OPTION         = "nice"
+	IONICE_CLASS_OPTION = "ionice-class"
+	IONICE_LEVEL_OPTION = "ionice-level"
+	// Snapshot all the volumes of the target at once with a VolumeGroupSnapshot
+	GROUP_SNAPSHOT_OPTION = "group-snapshot"
+	// Functions run in the target container before and after the volumes are snapshotted
+	// one by one when they cannot be snapshotted as a group
+	QUIESCE_OPTION   = "quiesce"
+	UNQUIESCE_OPTION = "unquiesce"
+	// What to do with the target volumes that cannot be snapshotted:
+	// fail the backup, skip them or back them up live (the default).
+	// The emptyDir and hostPath volumes cannot be backed up live. They are skipped by default.
+	UNSNAPSHOTTABLE_VOLUMES_OPTION = "unsnapshottable-volumes"
+	// Number of backups whose VolumeSnapshots are kept as restore points.
+	// The restore points are only recorded in the restore-point label of the VolumeSnapshots
+	// and in the volume-snapshots status annotation of the BackupSession, not in its status.
+	KEEP_VOLUME_SNAPSHOTS_OPTION = "keep-volume-snapshots"
+	// RestoreSession option. Set to volume-snapshot to roll the PVCs back
+	// to the VolumeSnapshots kept by the backup instead of using restic.
+	RESTORE_FROM_OPTION = "restore-from"
+	// RestoreSession option. Set to job to restore an OnlineKind target with a Job
+	// while the workload is scaled down instead of adding an initContainer to it.
+	RESTORE_MODE_OPTION = "restore-mode"
+	// RestoreSession options to restore the target snapshot somewhere else.
+	// The snapshot is restored either in the volumes of another workload
+	// or in a new PVC. The namespace defaults to the RestoreSession namespace.
+	CLONE_NAMESPACE_OPTION     = "clone-namespace"
+	CLONE_KIND_OPTION          = "clone-kind"
+	CLONE_NAME_OPTION          = "clone-name"
+	CLONE_PVC_OPTION           = "clone-pvc"
+	CLONE_PVC_SIZE_OPTION      = "clone-pvc-size"
+	CLONE_STORAGE_CLASS_OPTION = "clone-storage-class"
+	// RestoreSession option. Comma separated list of <backup path>=<restore path>
+	PATH_MAP_OPTION = "path-map"
+	// RestoreSession option. How the restored files replace the existing ones:
+	// overwrite (the default) writes on top of the existing files,
+	// mirror also deletes the files that are not in the snapshot,
+	// staged restores next to the existing files, verifies them and swaps them in.
+	// With a JobKind target, it applies to the files of the share path, not to the streamed Functions.
+	RESTORE_STRATEGY_OPTION = "restore-strategy"
+	// RestoreSession options changing the owner and the mode of the restored files.
+	// uid-map and gid-map are comma separated lists of <backup id>=<restore id>,
+	// owner forces the owner of all the files (uid[:gid]),
+	// mode-mask is an octal mask of the permission bits removed from the files (ie 027).
+	UID_MAP_OPTION   = "uid-map"
+	GID_MAP_OPTION   = "gid-map"
+	OWNER_OPTION     = "owner"
+	MODE_MASK_OPTION = "mode-mask"
+)
+
+const (
+	RESTORE_FROM_VOLUME_SNAPSHOT = "volume-snapshot"
+	JOB_RESTORE_MODE             = "job"
+	OVERWRITE_STRATEGY           = "overwrite"
+	MIRROR_STRATEGY              = "mirror"
+	STAGED_STRATEGY              = "staged"
+	FAIL_POLICY                  = "fail"
+	SKIP_POLICY                  = "skip"
+	LIVE_POLICY                  = "live"
+)
+
+const (
+	DEFAULT_SNAPSHOT_READY_TIMEOUT = 10 * time.Minute
+)
+
+type BackupOptions struct {
+	Tags              []string
+	Host              string
+	Excludes          []string
+	ExcludeIfPresent  []string
+	ExcludeCaches     bool
+	OneFileSystem     bool
+	ExcludeLargerThan string
+}
+
+// Gets the value of an option for the target.
+// The target specific option takes precedence.
+func getOption(obj metav1.Object, option string, targetName string) (value string, found bool) {
+	annotations := obj.GetAnnotations()
+	if value, found = annotations[ANNOTATION_PREFIX+option+"."+targetName]; found {
+		return
+	}
+	value, found = annotations[ANNOTATION_PREFIX+option]
+	return
+}
+
+func getListOption(obj metav1.Object, option string, targetName string) (values []string) {
+	value, _ := getOption(obj, option, targetName)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return
+}
+
+func getBoolOption(obj metav1.Object, option string, targetName string) bool {
+	value, _ := getOption(obj, option, targetName)
+	b, _ := strconv.ParseBool(value)
+	return b
+}
+
+func getIntOption(obj metav1.Object, option string, targetName string, defaultValue int) int {
+	if value, found := getOption(obj, option, targetName); found {
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	}
+	return defaultValue
+}
+
+// Gets the backup options of the target from the BackupConfiguration annotations
+func GetBackupOptions(backupConf formolv1alpha1.BackupConfiguration, targetName string) BackupOptions {
+	options := BackupOptions{
+		Excludes:         getListOption(&backupConf, EXCLUDE_OPTION, targetName),
+		ExcludeIfPresent: getListOption(&backupConf, EXCLUDE_IF_PRESENT_OPTION, targetName),
+		ExcludeCaches:    getBoolOption(&backupConf, EXCLUDE_CACHES_OPTION, targetName),
+		OneFileSystem:    getBoolOption(&backupConf, ONE_FILE_SYSTEM_OPTION, targetName),
+	}
+	options.ExcludeLargerThan, _ = getOption(&backupConf, EXCLUDE_LARGER_THAN_OPTION, targetName)
+	// The host has to be the same for all the snapshots of the target
+	// so restic finds the parent snapshot whatever Pod or Job does the backup
+	if host, found := getOption(&backupConf, HOST_OPTION, targetName); found {
+		options.Host = host
+	} else {
+		options.Host = backupConf.Namespace + "-" + targetName
+	}
+	options.Tags = []string{
+		"namespace=" + backupConf.Namespace,
+		"backupconfiguration=" + backupConf.Name,
+		"target=" + targetName,
+	}
+	for _, target := range backupConf.Spec.Targets {
+		if target.TargetName == targetName {
+			for _, container := range target.Containers {
+				options.Tags = append(options.Tags, "container="+container.Name)
+			}
+		}
+	}
+	return options
+}
+
+func getDurationOption(obj metav1.Object, option string, targetName string, defaultValue time.Duration) time.Duration {
+	if value, found := getOption(obj, option, targetName); found {
+		if duration, err := time.ParseDuration(value); err == nil {
+			return duration
+		}
+	}
+	return defaultValue
+}
+
+// Returns the restic backup arguments selecting the files matching the options
+func (o BackupOptions) filterArgs() (args []string) {
+	for _, exclude := range o.Excludes {
+		args = append(args, "--exclude", exclude)
+	}
+	for _, file := range o.ExcludeIfPresent {
+		args = append(args, "--exclude-if-present", file)
+	}
+	if o.ExcludeCaches {
+		args = append(args, "--exclude-caches")
+	}
+	if o.OneFileSystem {
+		args = append(args, "--one-file-system")
+	}
+	if o.ExcludeLargerThan != "" {
+		args = append(args, "--exclude-larger-than", o.ExcludeLargerThan)
+	}
+	return
+}
+
+// Where the snapshot of a target is cloned
+type CloneTarget struct {
+	Namespace string
+	// The workload receiving the snapshot
+	Kind formolv1alpha1.TargetKind
+	Name string
+	// Or the PVC created for the snapshot
+	PVC          string
+	PVCSize      string
+	StorageClass string
+}
+
+// Gets where the RestoreSession clones the target.
+// Returns nil when the target is restored in place.
+func GetCloneTarget(restoreSession *formolv1alpha1.RestoreSession, targetName string, targetKind formolv1alpha1.TargetKind) *CloneTarget {
+	clone := CloneTarget{
+		Namespace: restoreSession.Namespace,
+		Kind:      targetKind,
+	}
+	clone.Name, _ = getOption(restoreSession, CLONE_NAME_OPTION, targetName)
+	clone.PVC, _ = getOption(restoreSession, CLONE_PVC_OPTION, targetName)
+	if clone.Name == "" && clone.PVC == "" {
+		return nil
+	}
+	if namespace, found := getOption(restoreSession, CLONE_NAMESPACE_OPTION, targetName); found {
+		clone.Namespace = namespace
+	}
+	if kind, found := getOption(restoreSession, CLONE_KIND_OPTION, targetName); found {
+		clone.Kind = formolv1alpha1.TargetKind(kind)
+	}
+	clone.PVCSize, _ = getOption(restoreSession, CLONE_PVC_SIZE_OPTION, targetName)
+	clone.StorageClass, _ = getOption(restoreSession, CLONE_STORAGE_CLASS_OPTION, targetName)
+	return &clone
+}
+
+type RestoreOptions struct {
+	// The restore path of the backup paths
+	PathMap map[string]string
+	// Where the paths are restored
+	Root     string
+	Strategy string
+	// The owner changes of the restored files
+	UidMap map[int]int
+	GidMap map[int]int
+	// The forced owner of the restored files. -1 when not set
+	Uid int
+	Gid int
+	// Permission bits removed from the restored files
+	ModeMask fs.FileMode
+}
+
+// Gets the restore options of the target from the RestoreSession annotations
+func GetRestoreOptions(restoreSession *formolv1alpha1.RestoreSession, targetName string) RestoreOptions {
+	options := RestoreOptions{
+		PathMap:  GetPathMap(restoreSession, targetName),
+		Strategy: OVERWRITE_STRATEGY,
+		UidMap:   getIdMapOption(restoreSession, UID_MAP_OPTION, targetName),
+		GidMap:   getIdMapOption(restoreSession, GID_MAP_OPTION, targetName),
+		Uid:      -1,
+		Gid:      -1,
+	}
+	if strategy, found := getOption(restoreSession, RESTORE_STRATEGY_OPTION, targetName); found {
+		options.Strategy = strategy
+	}
+	if owner, found := getOption(restoreSession, OWNER_OPTION, targetName); found {
+		uid, gid, _ := strings.Cut(owner, ":")
+		if id, err := strconv.Atoi(uid); err == nil {
+			options.Uid = id
+		}
+		if id, err := strconv.Atoi(gid); err == nil {
+			options.Gid = id
+		}
+	}
+	if mask, found := getOption(restoreSession, MODE_MASK_OPTION, targetName); found {
+		if m, err := strconv.ParseUint(mask, 8, 32); err == nil {
+			options.ModeMask = fs.FileMode(m) & fs.ModePerm
+		}
+	}
+	return options
+}
+
+func getIdMapOption(obj metav1.Object, option string, targetName string) map[int]int {
+	idMap := make(map[int]int)
+	for _, value := range getListOption(obj, option, targetName) {
+		from, to, _ := strings.Cut(value, "=")
+		fromId, err := strconv.Atoi(from)
+		if err != nil {
+			continue
+		}
+		if toId, err := strconv.Atoi(to); err == nil {
+			idMap[fromId] = toId
+		}
+	}
+	return idMap
+}
+
+// Returns true if the owner or the mode of the restored files change
+func (o RestoreOptions) Remaps() bool {
+	return len(o.UidMap) > 0 || len(o.GidMap) > 0 || o.Uid >= 0 || o.Gid >= 0 || o.ModeMask != 0
+}
+
+// Returns true if the snapshot has to be restored path by path
+func (o RestoreOptions) PerPath() bool {
+	return len(o.PathMap) > 0 || o.Root != "" || o.Strategy != OVERWRITE_STRATEGY
+}
+
+// Where the backup path is restored
+func (o RestoreOptions) restorePath(path string) string {
+	return filepath.Join("/", o.Root, remapPath(path, o.PathMap))
+}
+
+// Gets the restore path of the backup paths from the path-map option
+func GetPathMap(obj metav1.Object, targetName string) map[string]string {
+	pathMap := make(map[string]string)
+	for _, value := range getListOption(obj, PATH_MAP_OPTION, targetName) {
+		if from, to, found := strings.Cut(value, "="); found {
+			pathMap[filepath.Clean(from)] = filepath.Clean(to)
+		}
+	}
+	return pathMap
+}
+
+// Maps the backup path to its restore path using the longest matching prefix
+func remapPath(path string, pathMap map[string]string) string {
+	path = filepath.Clean(path)
+	match := ""
+	for from := range pathMap {
+		if path == from || from == "/" || strings.HasPrefix(path, from+"/") {
+			if len(from) > len(match) {
+				match = from
+			}
+		}
+	}
+	if match == "" {
+		return path
+	}
+	return filepath.Join(pathMap[match], strings.TrimPrefix(path, match))
+}
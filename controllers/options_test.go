@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+
+	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRemapPath(t *testing.T) {
+	pathMap := map[string]string{
+		"/data":       "/restore",
+		"/data/cache": "/tmp/cache",
+		"/var/lib/db": "/db",
+	}
+	tests := []struct {
+		path    string
+		pathMap map[string]string
+		want    string
+	}{
+		{path: "/data", pathMap: pathMap, want: "/restore"},
+		{path: "/data/file", pathMap: pathMap, want: "/restore/file"},
+		{path: "/data/cache/file", pathMap: pathMap, want: "/tmp/cache/file"},
+		{path: "/database", pathMap: pathMap, want: "/database"},
+		{path: "/var/lib/db/", pathMap: pathMap, want: "/db"},
+		{path: "/data/../etc", pathMap: pathMap, want: "/etc"},
+		{path: "/other", pathMap: pathMap, want: "/other"},
+		{path: "/other", pathMap: map[string]string{"/": "/root"}, want: "/root/other"},
+		{path: "/data/file", pathMap: map[string]string{"/": "/root", "/data": "/restore"}, want: "/restore/file"},
+		{path: "/data", pathMap: nil, want: "/data"},
+	}
+	for _, tt := range tests {
+		if got := remapPath(tt.path, tt.pathMap); got != tt.want {
+			t.Errorf("remapPath(%q, %v) = %q, want %q", tt.path, tt.pathMap, got, tt.want)
+		}
+	}
+}
+
+func TestGetPathMap(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]string
+	}{
+		{
+			name:        "no option",
+			annotations: nil,
+			want:        map[string]string{},
+		},
+		{
+			name: "list with spaces and trailing slashes",
+			annotations: map[string]string{
+				ANNOTATION_PREFIX + PATH_MAP_OPTION: " /data/=/restore , /db=/var/lib/db/,",
+			},
+			want: map[string]string{"/data": "/restore", "/db": "/var/lib/db"},
+		},
+		{
+			name: "invalid entries are ignored",
+			annotations: map[string]string{
+				ANNOTATION_PREFIX + PATH_MAP_OPTION: "/data,/db=/restore",
+			},
+			want: map[string]string{"/db": "/restore"},
+		},
+		{
+			name: "the target option takes precedence",
+			annotations: map[string]string{
+				ANNOTATION_PREFIX + PATH_MAP_OPTION:          "/data=/all",
+				ANNOTATION_PREFIX + PATH_MAP_OPTION + ".web": "/data=/web",
+			},
+			want: map[string]string{"/data": "/web"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := GetPathMap(&metav1.ObjectMeta{Annotations: tt.annotations}, "web")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetPathMap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetIdMapOption(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  map[int]int
+	}{
+		{name: "empty", value: "", want: map[int]int{}},
+		{name: "list", value: "1000=2000, 0=1001", want: map[int]int{1000: 2000, 0: 1001}},
+		{name: "invalid entries are ignored", value: "a=1,1000,1001=b,1002=3000", want: map[int]int{1002: 3000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := &metav1.ObjectMeta{Annotations: map[string]string{ANNOTATION_PREFIX + UID_MAP_OPTION: tt.value}}
+			if got := getIdMapOption(obj, UID_MAP_OPTION, "web"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getIdMapOption(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetRestoreOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        RestoreOptions
+	}{
+		{
+			name: "defaults",
+			want: RestoreOptions{Strategy: OVERWRITE_STRATEGY, Uid: -1, Gid: -1},
+		},
+		{
+			name: "strategy of the target",
+			annotations: map[string]string{
+				ANNOTATION_PREFIX + RESTORE_STRATEGY_OPTION:          MIRROR_STRATEGY,
+				ANNOTATION_PREFIX + RESTORE_STRATEGY_OPTION + ".web": STAGED_STRATEGY,
+			},
+			want: RestoreOptions{Strategy: STAGED_STRATEGY, Uid: -1, Gid: -1},
+		},
+		{
+			name: "owner and id maps",
+			annotations: map[string]string{
+				ANNOTATION_PREFIX + OWNER_OPTION:   "1000:1001",
+				ANNOTATION_PREFIX + UID_MAP_OPTION: "0=1000",
+				ANNOTATION_PREFIX + GID_MAP_OPTION: "0=1001",
+			},
+			want: RestoreOptions{
+				Strategy: OVERWRITE_STRATEGY,
+				UidMap:   map[int]int{0: 1000},
+				GidMap:   map[int]int{0: 1001},
+				Uid:      1000,
+				Gid:      1001,
+			},
+		},
+		{
+			name:        "owner without group",
+			annotations: map[string]string{ANNOTATION_PREFIX + OWNER_OPTION: "1000"},
+			want:        RestoreOptions{Strategy: OVERWRITE_STRATEGY, Uid: 1000, Gid: -1},
+		},
+		{
+			name:        "group only",
+			annotations: map[string]string{ANNOTATION_PREFIX + OWNER_OPTION: ":1001"},
+			want:        RestoreOptions{Strategy: OVERWRITE_STRATEGY, Uid: -1, Gid: 1001},
+		},
+		{
+			name:        "octal mode mask",
+			annotations: map[string]string{ANNOTATION_PREFIX + MODE_MASK_OPTION: "027"},
+			want:        RestoreOptions{Strategy: OVERWRITE_STRATEGY, Uid: -1, Gid: -1, ModeMask: 027},
+		},
+		{
+			name:        "mode mask limited to the permission bits",
+			annotations: map[string]string{ANNOTATION_PREFIX + MODE_MASK_OPTION: "7777"},
+			want:        RestoreOptions{Strategy: OVERWRITE_STRATEGY, Uid: -1, Gid: -1, ModeMask: fs.ModePerm},
+		},
+		{
+			name:        "invalid mode mask",
+			annotations: map[string]string{ANNOTATION_PREFIX + MODE_MASK_OPTION: "u-w"},
+			want:        RestoreOptions{Strategy: OVERWRITE_STRATEGY, Uid: -1, Gid: -1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restoreSession := &formolv1alpha1.RestoreSession{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+			got := GetRestoreOptions(restoreSession, "web")
+			// The empty maps are not relevant
+			if len(got.PathMap) == 0 {
+				got.PathMap = nil
+			}
+			if len(got.UidMap) == 0 {
+				got.UidMap = nil
+			}
+			if len(got.GidMap) == 0 {
+				got.GidMap = nil
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetRestoreOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"fmt"
+	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Notes reporting the owner and mode changes of the restored files
+	OWNERSHIP_NOTE = "ownership"
+	MODE_MASK_NOTE = "mode-mask"
+)
+
+// Changes the owner and the mode of the files restored from the snapshot
+// and reports the changes in the RestoreSession status notes.
+// Only the files of the snapshot are changed. Their new owner and mode are computed
+// from the ones recorded in the snapshot so that remapping the files again changes nothing.
+func (s Session) RemapRestoredFiles(restoreSession *formolv1alpha1.RestoreSession, targetName string, snapshotId string, options RestoreOptions) error {
+	if !options.Remaps() {
+		return nil
+	}
+	nodes, err := s.getSnapshotNodes(snapshotId)
+	if err != nil {
+		return err
+	}
+	importRoot := s.getImportRoot(snapshotId)
+	chowned, chmoded := 0, 0
+	s.Log.V(0).Info("remapping the restored files", "snapshotId", snapshotId, "files", len(nodes))
+	for _, node := range nodes {
+		path := options.restorePath(trimImportRoot(node.Path, importRoot))
+		ownerChanged, modeChanged, err := remapFile(path, node, options)
+		if err != nil {
+			s.Log.Error(err, "unable to remap the restored file", "path", path)
+			return err
+		}
+		if ownerChanged {
+			chowned++
+		}
+		if modeChanged {
+			chmoded++
+		}
+	}
+	notes := make(map[string]string)
+	if changes := options.ownershipChanges(); changes != "" {
+		notes[OWNERSHIP_NOTE] = fmt.Sprintf("%s: %d files changed", changes, chowned)
+	}
+	if options.ModeMask != 0 {
+		notes[MODE_MASK_NOTE] = fmt.Sprintf("%04o: %d files changed", uint32(options.ModeMask), chmoded)
+	}
+	s.Log.V(0).Info("remapped the restored files", "notes", notes)
+	return s.setStatusNotes(restoreSession, targetName, notes)
+}
+
+// Sets the owner and the mode of the restored file from the ones of the snapshot node.
+// Returns whether the owner and the mode differ from the ones of the snapshot.
+// The files that were not restored are skipped.
+func remapFile(path string, node snapshotNode, options RestoreOptions) (ownerChanged bool, modeChanged bool, err error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// ie the image of a raw block volume
+			err = nil
+		}
+		return
+	}
+	uid, gid := options.remapOwner(int(node.Uid), int(node.Gid))
+	ownerChanged = uid != int(node.Uid) || gid != int(node.Gid)
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && (int(stat.Uid) != uid || int(stat.Gid) != gid) {
+		if err = os.Lchown(path, uid, gid); err != nil {
+			return
+		}
+		// chown clears the setuid and setgid bits
+		if info, err = os.Lstat(path); err != nil {
+			return
+		}
+	}
+	// The mode of a symlink is the mode of its target
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return
+	}
+	const modeBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+	mode := fs.FileMode(node.Mode) & modeBits
+	modeChanged = mode.Perm()&options.ModeMask != 0
+	if mode &^= options.ModeMask; info.Mode()&modeBits != mode {
+		err = os.Chmod(path, mode)
+	}
+	return
+}
+
+// Gets the new owner of a file owned by uid:gid in the snapshot
+func (o RestoreOptions) remapOwner(uid int, gid int) (int, int) {
+	if id, found := o.UidMap[uid]; found {
+		uid = id
+	}
+	if id, found := o.GidMap[gid]; found {
+		gid = id
+	}
+	if o.Uid >= 0 {
+		uid = o.Uid
+	}
+	if o.Gid >= 0 {
+		gid = o.Gid
+	}
+	return uid, gid
+}
+
+// Describes the owner changes
+func (o RestoreOptions) ownershipChanges() string {
+	changes := []string{}
+	for from, to := range o.UidMap {
+		changes = append(changes, fmt.Sprintf("uid %d=%d", from, to))
+	}
+	for from, to := range o.GidMap {
+		changes = append(changes, fmt.Sprintf("gid %d=%d", from, to))
+	}
+	sort.Strings(changes)
+	if o.Uid >= 0 {
+		changes = append(changes, fmt.Sprintf("uid %d", o.Uid))
+	}
+	if o.Gid >= 0 {
+		changes = append(changes, fmt.Sprintf("gid %d", o.Gid))
+	}
+	return strings.Join(changes, ", ")
+}
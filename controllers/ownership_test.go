@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestRemapFile(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("the remap changes the owner of the files")
+	}
+	// The maps are chained: remapping the files twice must not map 0 to 2000
+	options := RestoreOptions{
+		UidMap:   map[int]int{0: 1000, 1000: 2000},
+		GidMap:   map[int]int{0: 1000},
+		Uid:      -1,
+		Gid:      -1,
+		ModeMask: 027,
+	}
+	tests := []struct {
+		name             string
+		node             snapshotNode
+		wantUid          uint32
+		wantGid          uint32
+		wantMode         fs.FileMode
+		wantOwnerChanged bool
+		wantModeChanged  bool
+	}{
+		{
+			name:             "mapped owner and masked mode",
+			node:             snapshotNode{Type: "file", Mode: 0777},
+			wantUid:          1000,
+			wantGid:          1000,
+			wantMode:         0750,
+			wantOwnerChanged: true,
+			wantModeChanged:  true,
+		},
+		{
+			name:     "owner out of the maps",
+			node:     snapshotNode{Type: "file", Mode: 0640, Uid: 3000, Gid: 3000},
+			wantUid:  3000,
+			wantGid:  3000,
+			wantMode: 0640,
+		},
+		{
+			name:             "setuid kept after the chown",
+			node:             snapshotNode{Type: "file", Mode: uint32(fs.ModeSetuid | 0755), Uid: 1000, Gid: 3000},
+			wantUid:          2000,
+			wantGid:          3000,
+			wantMode:         fs.ModeSetuid | 0750,
+			wantOwnerChanged: true,
+			wantModeChanged:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(path, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			// As restic restores it
+			if err := os.Lchown(path, int(tt.node.Uid), int(tt.node.Gid)); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, fs.FileMode(tt.node.Mode)); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				ownerChanged, modeChanged, err := remapFile(path, tt.node, options)
+				if err != nil {
+					t.Fatalf("remapFile() failed: %v", err)
+				}
+				if ownerChanged != tt.wantOwnerChanged || modeChanged != tt.wantModeChanged {
+					t.Errorf("remapFile() = %v, %v, want %v, %v", ownerChanged, modeChanged, tt.wantOwnerChanged, tt.wantModeChanged)
+				}
+				info, err := os.Lstat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stat := info.Sys().(*syscall.Stat_t)
+				if stat.Uid != tt.wantUid || stat.Gid != tt.wantGid || info.Mode() != tt.wantMode {
+					t.Errorf("remap %d: file = %d:%d %v, want %d:%d %v", i+1, stat.Uid, stat.Gid, info.Mode(), tt.wantUid, tt.wantGid, tt.wantMode)
+				}
+			}
+		})
+	}
+}
+
+func TestRemapFileNotRestored(t *testing.T) {
+	ownerChanged, modeChanged, err := remapFile(filepath.Join(t.TempDir(), "missing"), snapshotNode{Type: "file"}, RestoreOptions{Uid: 1000, Gid: -1})
+	if err != nil || ownerChanged || modeChanged {
+		t.Errorf("remapFile() of a file that was not restored = %v, %v, %v, want nothing", ownerChanged, modeChanged, err)
+	}
+}
@@ -0,0 +1,28 @@
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Replaces restic with a shell script for the duration of the test.
+// Returns the directory of the script, where it can keep its state.
+func fakeRestic(t *testing.T, script string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "restic")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{FORMOL_LIMIT_UPLOAD, FORMOL_LIMIT_DOWNLOAD, FORMOL_NICE, FORMOL_IONICE_CLASS, FORMOL_IONICE_LEVEL} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("FAKE_RESTIC_DIR", dir)
+	resticExec := RESTIC_EXEC
+	RESTIC_EXEC = path
+	t.Cleanup(func() {
+		RESTIC_EXEC = resticExec
+	})
+	return dir
+}
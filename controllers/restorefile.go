@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Follow at most that many symlinks when resolving a path in the target container
+const MAX_SYMLINKS = 40
+
+// Resolves the path in the filesystem of the target container.
+// The symlinks are resolved relatively to the container root so the path cannot escape it.
+func secureJoin(root string, path string) (string, error) {
+	resolved := ""
+	remaining := strings.Split(filepath.Clean("/"+path), "/")
+	links := 0
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			if resolved == "." || resolved == "/" {
+				resolved = ""
+			}
+			continue
+		}
+		next := resolved + "/" + component
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The rest of the path does not exist yet
+				resolved = filepath.Join(append([]string{next}, remaining...)...)
+				break
+			}
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > MAX_SYMLINKS {
+			return "", fmt.Errorf("too many symlinks in %s", path)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			resolved = ""
+		}
+		remaining = append(strings.Split(link, "/"), remaining...)
+	}
+	return filepath.Join(root, "/"+resolved), nil
+}
+
+// Writes the file of the snapshot in the filesystem of the running target container
+// with the owner, the mode and the mtime it has in the snapshot.
+func (s Session) RestoreFile(snapshotId string, path string) error {
+	root, err := s.getTargetContainerRoot()
+	if err != nil {
+		return err
+	}
+	return s.restoreFile(root, snapshotId, path)
+}
+
+// Writes the file of the snapshot under root. The missing parent directories
+// are created with the owner, the mode and the mtime they have in the snapshot.
+func (s Session) restoreFile(root string, snapshotId string, path string) error {
+	path = filepath.Join("/", path)
+	nodes, err := s.getSnapshotNodes(snapshotId, path)
+	if err != nil {
+		return err
+	}
+	node, found := nodes[path]
+	if !found {
+		return fmt.Errorf("%s is not in snapshot %s", path, snapshotId)
+	}
+	if node.Type != "file" {
+		return fmt.Errorf("%s is a %s, not a file", path, node.Type)
+	}
+	target, err := secureJoin(root, path)
+	if err != nil {
+		s.Log.Error(err, "unable to resolve the path in the target container", "path", path)
+		return err
+	}
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		return fmt.Errorf("%s is a directory in the target container", path)
+	}
+	dirs, err := s.makeParentDirs(root, snapshotId, path)
+	if err != nil {
+		s.Log.Error(err, "unable to create the parent directories", "path", path)
+		return err
+	}
+	// Write next to the file and swap it in once complete
+	file, err := os.CreateTemp(filepath.Dir(target), ".formol-restore-*")
+	if err != nil {
+		s.Log.Error(err, "unable to create the file in the target container", "path", path)
+		return err
+	}
+	defer os.Remove(file.Name())
+	s.Log.V(0).Info("restoring file", "snapshotId", snapshotId, "path", path, "target", target)
+	cmd := ResticCommand("dump", snapshotId, path)
+	cmd.Stdout = file
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		s.Log.Error(err, "unable to dump the file", "path", path, "stderr", stderr.String())
+		return err
+	}
+	if err := setNodeMetadata(file.Name(), node); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), target); err != nil {
+		return err
+	}
+	// The new entries changed the mtime of the created directories. Deepest first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if mtime := dirs[i].node.Mtime; !mtime.IsZero() {
+			if err := os.Chtimes(dirs[i].path, mtime, mtime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// A directory created by the restore of a file
+type createdDir struct {
+	path string
+	node snapshotNode
+}
+
+// Creates the missing parent directories of the path under root with the owner
+// and the mode they have in the snapshot. Returns the created directories, topmost first.
+func (s Session) makeParentDirs(root string, snapshotId string, path string) (dirs []createdDir, err error) {
+	missing := []string{}
+	for dir := filepath.Dir(path); dir != "/"; dir = filepath.Dir(dir) {
+		resolved, err := secureJoin(root, dir)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Lstat(resolved); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		missing = append([]string{dir}, missing...)
+	}
+	if len(missing) == 0 {
+		return
+	}
+	// The directories are under the topmost missing one
+	nodes, err := s.getSnapshotNodes(snapshotId, missing[0])
+	if err != nil {
+		return
+	}
+	for _, dir := range missing {
+		resolved, err := secureJoin(root, dir)
+		if err != nil {
+			return dirs, err
+		}
+		if err := os.Mkdir(resolved, 0700); err != nil {
+			return dirs, err
+		}
+		node, found := nodes[dir]
+		if !found || node.Type != "dir" {
+			// Unknown to the snapshot listing
+			node = snapshotNode{Mode: uint32(fs.ModeDir | 0755), Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+		}
+		if err := setNodeMetadata(resolved, node); err != nil {
+			return dirs, err
+		}
+		dirs = append(dirs, createdDir{path: resolved, node: node})
+	}
+	return
+}
+
+// Sets the owner and the mode of the file to the ones of the snapshot node
+// and its mtime when the node has one
+func setNodeMetadata(path string, node snapshotNode) error {
+	if err := os.Lchown(path, int(node.Uid), int(node.Gid)); err != nil {
+		return err
+	}
+	// After the chown that clears the setuid and setgid bits
+	if err := os.Chmod(path, fs.FileMode(node.Mode)); err != nil {
+		return err
+	}
+	if node.Mtime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(path, node.Mtime, node.Mtime)
+}
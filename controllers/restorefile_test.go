@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+func TestSecureJoin(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a", "b", "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"abs":    "/a",
+		"absout": "/etc",
+		"rel":    "a/b",
+		"a/lnk":  "../a/b",
+		"up":     "../../..",
+		"loop1":  "loop2",
+		"loop2":  "loop1",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain path", path: "a/b/file", want: "a/b/file"},
+		{name: "absolute path", path: "/a/b/file", want: "a/b/file"},
+		{name: "dotdot above the root", path: "../../etc/passwd", want: "etc/passwd"},
+		{name: "dotdot in the middle", path: "/a/../../b", want: "b"},
+		{name: "missing path", path: "a/missing/file", want: "a/missing/file"},
+		{name: "absolute symlink", path: "abs/b/file", want: "a/b/file"},
+		{name: "absolute symlink out of the root", path: "absout/passwd", want: "etc/passwd"},
+		{name: "relative symlink", path: "rel/file", want: "a/b/file"},
+		{name: "relative symlink in a directory", path: "a/lnk/file", want: "a/b/file"},
+		{name: "relative symlink above the root", path: "up/etc/passwd", want: "etc/passwd"},
+		{name: "symlink as last component", path: "a/b/../../rel", want: "a/b"},
+		{name: "symlink loop", path: "loop1/file", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := secureJoin(root, tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("secureJoin(%q) = %q, want an error", tt.path, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("secureJoin(%q) failed: %v", tt.path, err)
+			}
+			if want := filepath.Join(root, tt.want); got != want {
+				t.Errorf("secureJoin(%q) = %q, want %q", tt.path, got, want)
+			}
+		})
+	}
+}
+
+// A fake restic listing the nodes of ls<path with _ for /> and dumping "content"
+const restoreFileRestic = `case "$1" in
+ls)
+	f="$FAKE_RESTIC_DIR/ls$(echo "$4" | tr / _)"
+	echo '{"struct_type":"snapshot","id":"1234"}'
+	[ -f "$f" ] && cat "$f"
+	;;
+dump)
+	printf content
+	;;
+esac
+`
+
+func TestRestoreFile(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("the restore changes the owner of the files")
+	}
+	mtime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	dirNode := snapshotNode{StructType: "node", Path: "/data/sub", Type: "dir", Mode: uint32(fs.ModeDir | 0750), Uid: 1000, Gid: 1001, Mtime: mtime}
+	fileNode := snapshotNode{StructType: "node", Path: "/data/sub/file", Type: "file", Mode: 0640, Uid: 1002, Gid: 1003, Mtime: mtime}
+	listings := map[string][]snapshotNode{
+		"/data/sub/file": {fileNode},
+		"/data/sub":      {dirNode, fileNode},
+		"/data/dir":      {{StructType: "node", Path: "/data/dir", Type: "dir", Mode: uint32(fs.ModeDir | 0755)}},
+	}
+	tests := []struct {
+		name    string
+		path    string
+		dirs    []string
+		wantErr bool
+	}{
+		{name: "existing parent", path: "/data/sub/file", dirs: []string{"data/sub"}},
+		{name: "missing parents", path: "data/sub/file", dirs: []string{"data"}},
+		{name: "directory of the snapshot", path: "/data/dir", dirs: []string{"data"}, wantErr: true},
+		{name: "not in the snapshot", path: "/data/missing", dirs: []string{"data"}, wantErr: true},
+		{name: "directory of the target container", path: "/data/sub/file", dirs: []string{"data/sub/file"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resticDir := fakeRestic(t, restoreFileRestic)
+			for path, nodes := range listings {
+				var listing []byte
+				for _, node := range nodes {
+					line, err := json.Marshal(node)
+					if err != nil {
+						t.Fatal(err)
+					}
+					listing = append(append(listing, line...), '\n')
+				}
+				if err := os.WriteFile(filepath.Join(resticDir, "ls"+strings.ReplaceAll(path, "/", "_")), listing, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			root := t.TempDir()
+			for _, dir := range tt.dirs {
+				if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := Session{Log: logr.Discard()}
+			err := s.restoreFile(root, "1234", tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("restoreFile() succeeded, want an error")
+				}
+				if _, err := os.Lstat(filepath.Join(root, "data", "sub")); tt.dirs[0] == "data" && !os.IsNotExist(err) {
+					t.Errorf("restoreFile() created the parent directories: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("restoreFile() failed: %v", err)
+			}
+			wants := map[string]snapshotNode{"data/sub/file": fileNode}
+			if tt.dirs[0] == "data" {
+				wants["data/sub"] = dirNode
+			}
+			for name, want := range wants {
+				info, err := os.Lstat(filepath.Join(root, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				stat := info.Sys().(*syscall.Stat_t)
+				if info.Mode() != fs.FileMode(want.Mode) || stat.Uid != want.Uid || stat.Gid != want.Gid || !info.ModTime().Equal(mtime) {
+					t.Errorf("%s = %v %d:%d %v, want %v %d:%d %v", name, info.Mode(), stat.Uid, stat.Gid, info.ModTime(), fs.FileMode(want.Mode), want.Uid, want.Gid, mtime)
+				}
+			}
+			if content, err := os.ReadFile(filepath.Join(root, "data", "sub", "file")); err != nil || string(content) != "content" {
+				t.Errorf("restored file = %q, %v, want the dumped content", content, err)
+			}
+		})
+	}
+}
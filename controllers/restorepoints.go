@@ -0,0 +1,305 @@
+package controllers
+
+import (
+	"fmt"
+	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Label of the VolumeSnapshots kept as restore points
+	RESTORE_POINT_LABEL = "restore-point"
+	// Note listing the VolumeSnapshots kept by the backup as <pvc>=<volumesnapshot>,...
+	VOLUME_SNAPSHOTS_NOTE = "volume-snapshots"
+	// How long to wait for a PVC to be deleted before rolling it back
+	PVC_DELETE_TIMEOUT = 5 * time.Minute
+	// Annotation of the rolled back PVC with the name of the PV it was bound to
+	ROLLED_BACK_PV_ANNOTATION = ANNOTATION_PREFIX + "rolled-back-pv"
+	// Annotation of the PV kept by the rollback with its former reclaim policy
+	RECLAIM_POLICY_ANNOTATION = ANNOTATION_PREFIX + "reclaim-policy"
+)
+
+// Returns true if the RestoreSession rolls the target PVCs back to the VolumeSnapshots
+func RestoreFromVolumeSnapshots(restoreSession *formolv1alpha1.RestoreSession, targetName string) bool {
+	value, _ := getOption(restoreSession, RESTORE_FROM_OPTION, targetName)
+	return value == RESTORE_FROM_VOLUME_SNAPSHOT
+}
+
+// Keeps the VolumeSnapshots of the backup as restore points when the keep-volume-snapshots
+// option is set and deletes the oldest ones. Otherwise deletes them.
+// The PVCs created from the VolumeSnapshots are always deleted.
+func (s Session) KeepSnapshotVolumes(backupConf formolv1alpha1.BackupConfiguration, backupSession *formolv1alpha1.BackupSession, targetName string) error {
+	keep := getIntOption(&backupConf, KEEP_VOLUME_SNAPSHOTS_OPTION, targetName, 0)
+	if keep <= 0 {
+		return s.DeleteSnapshotVolumes(backupSession.Namespace, backupSession.Name, targetName)
+	}
+	labels := client.MatchingLabels{
+		BACKUPSESSION_LABEL: backupSession.Name,
+		TARGET_LABEL:        targetName,
+	}
+	vss := volumesnapshotv1.VolumeSnapshotList{}
+	if err := s.List(s.Context, &vss, client.InNamespace(backupSession.Namespace), labels); err != nil {
+		s.Log.Error(err, "unable to list the volumesnapshots", "backupsession", backupSession.Name)
+		return err
+	}
+	restorePoints := []string{}
+	for i := range vss.Items {
+		vs := &vss.Items[i]
+		patch := client.MergeFrom(vs.DeepCopy())
+		// The restore points outlive the BackupSession
+		vs.SetOwnerReferences(nil)
+		vs.Labels[RESTORE_POINT_LABEL] = "true"
+		if err := s.Patch(s.Context, vs, patch); err != nil {
+			s.Log.Error(err, "unable to keep the volumesnapshot", "vs", vs.Name)
+			return err
+		}
+		s.Log.V(0).Info("volumesnapshot kept as a restore point", "vs", vs.Name)
+		if vs.Spec.Source.PersistentVolumeClaimName != nil {
+			restorePoints = append(restorePoints, *vs.Spec.Source.PersistentVolumeClaimName+"="+vs.Name)
+		}
+	}
+	// The VolumeSnapshots of a VolumeGroupSnapshot belong to the group. They are not kept.
+	if err := s.deleteGroupSnapshots(backupSession.Namespace, labels); err != nil {
+		return err
+	}
+	if err := s.deleteBackupPVCs(backupSession.Namespace, labels); err != nil {
+		return err
+	}
+	if err := s.setStatusNotes(backupSession, targetName, map[string]string{
+		VOLUME_SNAPSHOTS_NOTE: strings.Join(restorePoints, ","),
+	}); err != nil {
+		s.Log.Error(err, "unable to record the restore points")
+		return err
+	}
+	return s.pruneRestorePoints(backupSession.Namespace, backupConf.Name, targetName, keep)
+}
+
+// Deletes the restore points of the target except the ones of the last backups
+func (s Session) pruneRestorePoints(namespace string, backupConfName string, targetName string, keep int) error {
+	vss := volumesnapshotv1.VolumeSnapshotList{}
+	if err := s.List(s.Context, &vss, client.InNamespace(namespace), client.MatchingLabels{
+		BACKUPCONF_LABEL:    backupConfName,
+		TARGET_LABEL:        targetName,
+		RESTORE_POINT_LABEL: "true",
+	}); err != nil {
+		s.Log.Error(err, "unable to list the restore points", "target", targetName)
+		return err
+	}
+	// A backup can have several VolumeSnapshots
+	backups := make(map[string]time.Time)
+	for _, vs := range vss.Items {
+		name := vs.Labels[BACKUPSESSION_LABEL]
+		if t, found := backups[name]; !found || vs.CreationTimestamp.Time.Before(t) {
+			backups[name] = vs.CreationTimestamp.Time
+		}
+	}
+	if len(backups) <= keep {
+		return nil
+	}
+	names := make([]string, 0, len(backups))
+	for name := range backups {
+		names = append(names, name)
+	}
+	// Newest first
+	sort.Slice(names, func(i, j int) bool {
+		return backups[names[i]].After(backups[names[j]])
+	})
+	expired := make(map[string]bool)
+	for _, name := range names[keep:] {
+		expired[name] = true
+	}
+	for _, vs := range vss.Items {
+		if !expired[vs.Labels[BACKUPSESSION_LABEL]] {
+			continue
+		}
+		if err := s.Delete(s.Context, &vs); err != nil && !errors.IsNotFound(err) {
+			s.Log.Error(err, "unable to delete the restore point", "vs", vs.Name)
+			return err
+		}
+		s.Log.V(0).Info("restore point deleted", "vs", vs.Name)
+	}
+	return nil
+}
+
+// Gets the VolumeSnapshots kept as restore points by the backup of the target
+func (s Session) GetRestorePoints(namespace string, backupSessionName string, targetName string) ([]volumesnapshotv1.VolumeSnapshot, error) {
+	vss := volumesnapshotv1.VolumeSnapshotList{}
+	if err := s.List(s.Context, &vss, client.InNamespace(namespace), client.MatchingLabels{
+		BACKUPSESSION_LABEL: backupSessionName,
+		TARGET_LABEL:        targetName,
+		RESTORE_POINT_LABEL: "true",
+	}); err != nil {
+		s.Log.Error(err, "unable to list the restore points", "backupsession", backupSessionName)
+		return nil, err
+	}
+	if len(vss.Items) == 0 {
+		return nil, fmt.Errorf("backupsession %s kept no volumesnapshot for target %s", backupSessionName, targetName)
+	}
+	return vss.Items, nil
+}
+
+// Rolls the PVCs of the target back to the VolumeSnapshots kept by the backup.
+// The target must be scaled down so the PVCs are not in use.
+func (s Session) RollbackVolumes(namespace string, backupSessionName string, targetName string) error {
+	vss, err := s.GetRestorePoints(namespace, backupSessionName, targetName)
+	if err != nil {
+		return err
+	}
+	for _, vs := range vss {
+		if vs.Spec.Source.PersistentVolumeClaimName == nil {
+			continue
+		}
+		if err := s.rollbackVolume(vs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replaces the source PVC of the VolumeSnapshot with a new PVC provisioned from the VolumeSnapshot.
+// The PV of the old PVC is kept with the Retain reclaim policy. If the new PVC cannot be created,
+// the old PVC is bound to it again. Otherwise the old PV is left Released for the rollback
+// to be undone. Delete it once the rolled back data is checked.
+func (s Session) rollbackVolume(vs volumesnapshotv1.VolumeSnapshot) error {
+	if vs.Status == nil || vs.Status.ReadyToUse == nil || !*vs.Status.ReadyToUse {
+		return fmt.Errorf("volumesnapshot %s is not ready to use", vs.Name)
+	}
+	key := client.ObjectKey{
+		Namespace: vs.Namespace,
+		Name:      *vs.Spec.Source.PersistentVolumeClaimName,
+	}
+	pvc := corev1.PersistentVolumeClaim{}
+	if err := s.Get(s.Context, key, &pvc); err != nil {
+		s.Log.Error(err, "unable to get the pvc to roll back", "pvc", key.Name)
+		return err
+	}
+	if pvc.Spec.DataSource != nil && pvc.Spec.DataSource.Kind == "VolumeSnapshot" && pvc.Spec.DataSource.Name == vs.Name {
+		s.Log.V(0).Info("pvc already rolled back", "pvc", pvc.Name, "vs", vs.Name)
+		return nil
+	}
+	pvName := pvc.Spec.VolumeName
+	if pvName != "" {
+		if err := s.retainPV(pvName); err != nil {
+			return err
+		}
+	}
+	// Only keep the labels. The annotations are about the old PV binding.
+	newPVC := corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: pvc.Namespace,
+			Name:      pvc.Name,
+			Labels:    pvc.Labels,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: pvc.Spec.StorageClassName,
+			AccessModes:      pvc.Spec.AccessModes,
+			VolumeMode:       pvc.Spec.VolumeMode,
+			Resources:        *pvc.Spec.Resources.DeepCopy(),
+			DataSource: &corev1.TypedLocalObjectReference{
+				APIGroup: func() *string { s := "snapshot.storage.k8s.io"; return &s }(),
+				Kind:     "VolumeSnapshot",
+				Name:     vs.Name,
+			},
+		},
+	}
+	if pvName != "" {
+		newPVC.Annotations = map[string]string{ROLLED_BACK_PV_ANNOTATION: pvName}
+	}
+	// The new volume cannot be smaller than the snapshot
+	if size := vs.Status.RestoreSize; size != nil {
+		if request, found := newPVC.Spec.Resources.Requests[corev1.ResourceStorage]; !found || request.Cmp(*size) < 0 {
+			if newPVC.Spec.Resources.Requests == nil {
+				newPVC.Spec.Resources.Requests = corev1.ResourceList{}
+			}
+			newPVC.Spec.Resources.Requests[corev1.ResourceStorage] = *size
+		}
+	}
+	s.Log.V(0).Info("rolling back pvc", "pvc", pvc.Name, "vs", vs.Name, "pv", pvName)
+	if err := s.Delete(s.Context, &pvc); err != nil && !errors.IsNotFound(err) {
+		s.Log.Error(err, "unable to delete the pvc", "pvc", pvc.Name)
+		return err
+	}
+	if err := wait.PollImmediate(2*time.Second, PVC_DELETE_TIMEOUT, func() (bool, error) {
+		err := s.Get(s.Context, key, &corev1.PersistentVolumeClaim{})
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}); err != nil {
+		s.Log.Error(err, "the pvc is still there", "pvc", pvc.Name)
+		return err
+	}
+	if err := s.Create(s.Context, &newPVC); err != nil {
+		s.Log.Error(err, "unable to create the pvc from the volumesnapshot", "pvc", newPVC.Name, "vs", vs.Name)
+		if pvName != "" {
+			if err := s.rebindPVC(pvc, pvName); err != nil {
+				s.Log.Error(err, "unable to bind the pvc to its old pv again", "pvc", pvc.Name, "pv", pvName)
+			}
+		}
+		return err
+	}
+	if pvName != "" {
+		s.Log.V(0).Info("pvc rolled back. The old pv is kept", "pvc", pvc.Name, "pv", pvName)
+	}
+	return nil
+}
+
+// Sets the reclaim policy of the PV to Retain so the PV outlives its PVC.
+// The former reclaim policy is kept in an annotation of the PV.
+func (s Session) retainPV(name string) error {
+	pv := corev1.PersistentVolume{}
+	if err := s.Get(s.Context, client.ObjectKey{Name: name}, &pv); err != nil {
+		s.Log.Error(err, "unable to get the pv", "pv", name)
+		return err
+	}
+	if pv.Spec.PersistentVolumeReclaimPolicy == corev1.PersistentVolumeReclaimRetain {
+		return nil
+	}
+	patch := client.MergeFrom(pv.DeepCopy())
+	if pv.Annotations == nil {
+		pv.Annotations = make(map[string]string)
+	}
+	pv.Annotations[RECLAIM_POLICY_ANNOTATION] = string(pv.Spec.PersistentVolumeReclaimPolicy)
+	pv.Spec.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimRetain
+	if err := s.Patch(s.Context, &pv, patch); err != nil {
+		s.Log.Error(err, "unable to retain the pv", "pv", name)
+		return err
+	}
+	return nil
+}
+
+// Binds the deleted PVC to its PV again
+func (s Session) rebindPVC(pvc corev1.PersistentVolumeClaim, pvName string) error {
+	pv := corev1.PersistentVolume{}
+	if err := s.Get(s.Context, client.ObjectKey{Name: pvName}, &pv); err != nil {
+		return err
+	}
+	// A Released PV still references the deleted PVC
+	patch := client.MergeFrom(pv.DeepCopy())
+	pv.Spec.ClaimRef = nil
+	if err := s.Patch(s.Context, &pv, patch); err != nil {
+		return err
+	}
+	oldPVC := corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: pvc.Namespace,
+			Name:      pvc.Name,
+			Labels:    pvc.Labels,
+		},
+		Spec: pvc.Spec,
+	}
+	oldPVC.Spec.VolumeName = pvName
+	if err := s.Create(s.Context, &oldPVC); err != nil {
+		return err
+	}
+	s.Log.V(0).Info("pvc bound to its old pv again", "pvc", pvc.Name, "pv", pvName)
+	return nil
+}
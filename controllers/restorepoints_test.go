@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// Gets a Session talking to a fake API server holding the objects
+func fakeClientSession(objects ...client.Object) Session {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(volumesnapshotv1.AddToScheme(scheme))
+	return Session{
+		Client:    fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+		Context:   context.Background(),
+		Log:       logr.Discard(),
+		Scheme:    scheme,
+		Namespace: "default",
+	}
+}
+
+func rollbackObjects(ready bool) (*volumesnapshotv1.VolumeSnapshot, *corev1.PersistentVolumeClaim, *corev1.PersistentVolume) {
+	pvcName := "data"
+	restoreSize := resource.MustParse("2Gi")
+	vs := &volumesnapshotv1.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "vs-backupsession-1-data"},
+		Spec: volumesnapshotv1.VolumeSnapshotSpec{
+			Source: volumesnapshotv1.VolumeSnapshotSource{PersistentVolumeClaimName: &pvcName},
+		},
+		Status: &volumesnapshotv1.VolumeSnapshotStatus{ReadyToUse: &ready, RestoreSize: &restoreSize},
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: pvcName, Labels: map[string]string{"app": "web"}},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+			},
+			VolumeName: "pv-data",
+		},
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-data"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+			ClaimRef:                      &corev1.ObjectReference{Namespace: "default", Name: pvcName},
+		},
+	}
+	return vs, pvc, pv
+}
+
+func TestRollbackVolume(t *testing.T) {
+	vs, pvc, pv := rollbackObjects(true)
+	s := fakeClientSession(vs, pvc, pv)
+	if err := s.rollbackVolume(*vs); err != nil {
+		t.Fatalf("rollbackVolume() failed: %v", err)
+	}
+	newPVC := corev1.PersistentVolumeClaim{}
+	if err := s.Get(s.Context, client.ObjectKeyFromObject(pvc), &newPVC); err != nil {
+		t.Fatalf("the rolled back pvc is missing: %v", err)
+	}
+	if newPVC.Spec.DataSource == nil || newPVC.Spec.DataSource.Name != vs.Name || newPVC.Spec.VolumeName != "" {
+		t.Errorf("rolled back pvc spec = %+v, want a new volume from %s", newPVC.Spec, vs.Name)
+	}
+	if request := newPVC.Spec.Resources.Requests[corev1.ResourceStorage]; request.Cmp(*vs.Status.RestoreSize) != 0 {
+		t.Errorf("rolled back pvc request = %s, want the restore size %s", request.String(), vs.Status.RestoreSize.String())
+	}
+	if newPVC.Annotations[ROLLED_BACK_PV_ANNOTATION] != pv.Name || newPVC.Labels["app"] != "web" {
+		t.Errorf("rolled back pvc metadata = %+v, want the old pv annotation and the labels", newPVC.ObjectMeta)
+	}
+	oldPV := corev1.PersistentVolume{}
+	if err := s.Get(s.Context, client.ObjectKeyFromObject(pv), &oldPV); err != nil {
+		t.Fatalf("the old pv is missing: %v", err)
+	}
+	if oldPV.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimRetain {
+		t.Errorf("old pv reclaim policy = %s, want Retain", oldPV.Spec.PersistentVolumeReclaimPolicy)
+	}
+	if oldPV.Annotations[RECLAIM_POLICY_ANNOTATION] != string(corev1.PersistentVolumeReclaimDelete) {
+		t.Errorf("old pv annotations = %v, want the former reclaim policy", oldPV.Annotations)
+	}
+	// A second rollback leaves the new pvc alone
+	if err := s.rollbackVolume(*vs); err != nil {
+		t.Fatalf("second rollbackVolume() failed: %v", err)
+	}
+}
+
+func TestRollbackVolumeNotReady(t *testing.T) {
+	vs, pvc, pv := rollbackObjects(false)
+	s := fakeClientSession(vs, pvc, pv)
+	if err := s.rollbackVolume(*vs); err == nil {
+		t.Fatal("rollbackVolume() of a volumesnapshot not ready to use succeeded, want an error")
+	}
+	current := corev1.PersistentVolumeClaim{}
+	if err := s.Get(s.Context, client.ObjectKeyFromObject(pvc), &current); err != nil || current.Spec.VolumeName != pv.Name {
+		t.Errorf("pvc = %+v, %v, want it untouched", current.Spec, err)
+	}
+}
+
+func TestRebindPVC(t *testing.T) {
+	_, pvc, pv := rollbackObjects(true)
+	s := fakeClientSession(pv)
+	if err := s.rebindPVC(*pvc, pv.Name); err != nil {
+		t.Fatalf("rebindPVC() failed: %v", err)
+	}
+	current := corev1.PersistentVolumeClaim{}
+	if err := s.Get(s.Context, client.ObjectKeyFromObject(pvc), &current); err != nil || current.Spec.VolumeName != pv.Name {
+		t.Errorf("pvc = %+v, %v, want it bound to %s", current.Spec, err, pv.Name)
+	}
+	released := corev1.PersistentVolume{}
+	if err := s.Get(s.Context, client.ObjectKeyFromObject(pv), &released); err != nil || released.Spec.ClaimRef != nil {
+		t.Errorf("pv claimRef = %+v, %v, want it cleared", released.Spec.ClaimRef, err)
+	}
+	if err := s.rebindPVC(*pvc, "missing"); !errors.IsNotFound(err) {
+		t.Errorf("rebindPVC() to a missing pv = %v, want not found", err)
+	}
+}
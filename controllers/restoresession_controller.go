@@ -3,13 +3,19 @@ package controllers
 import (
 	"context"
 	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"os"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"time"
 )
 
+// The clone Jobs in another namespace are not owned by the RestoreSession
+// and do not trigger a reconcile. Poll them to see their failures.
+const CLONE_JOB_POLL_PERIOD = 30 * time.Second
+
 type RestoreSessionReconciler struct {
 	Session
 	backupConf     formolv1alpha1.BackupConfiguration
@@ -68,13 +74,37 @@ func (r *RestoreSessionReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		}
 	}
 
+	r.Vars = map[string]string{
+		FORMOL_SESSION_KIND: "RestoreSession",
+		FORMOL_SESSION_NAME: r.Name,
+		FORMOL_NAMESPACE:    r.Namespace,
+		FORMOL_TARGET_NAME:  targetName,
+		FORMOL_BACKUP_PATHS: os.Getenv(formolv1alpha1.BACKUP_PATHS),
+		FORMOL_SNAPSHOT_ID:  backupTargetStatus.SnapshotId,
+	}
+	if backupTargetStatus.StartTime != nil {
+		r.Vars[FORMOL_BACKUP_TIME] = backupTargetStatus.StartTime.Format(time.RFC3339)
+	}
+
 	// Do preliminary checks with the repository
 	if err = r.SetResticEnv(backupConf); err != nil {
 		r.Log.Error(err, "unable to set restic env")
 		return ctrl.Result{}, err
 	}
 
+	switch restoreTargetStatus.SessionState {
+	case formolv1alpha1.Initializing, formolv1alpha1.Running, formolv1alpha1.Finalize:
+		// The restore Functions can use the outputs saved in the snapshot by the backup Functions
+		r.Outputs = r.getSnapshotOutputs(backupTargetStatus.SnapshotId)
+	}
+
+	// The target is left alone when its snapshot is cloned somewhere else
+	clone := GetCloneTarget(&restoreSession, targetName, target.TargetKind)
+
 	var newSessionState formolv1alpha1.SessionState
+	var requeueAfter time.Duration
+	// Details about the target status reported in the RestoreSession annotations
+	notes := make(map[string]string)
 	switch restoreTargetStatus.SessionState {
 	case formolv1alpha1.New:
 		// New session move to Initializing
@@ -84,7 +114,10 @@ func (r *RestoreSessionReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		// Run the initializing Steps and then move to Initialized or Failure
 		r.Log.V(0).Info("Start to run the backup initializing steps is any")
 		// Runs the Steps functions in chroot env
-		if err := r.runInitializeSteps(target); err != nil {
+		if clone != nil {
+			r.Log.V(0).Info("Cloning the target. Skipping the initializing steps")
+			newSessionState = formolv1alpha1.Initialized
+		} else if err := r.runInitializeSteps(target); err != nil {
 			r.Log.Error(err, "unable to run the initialization steps")
 			newSessionState = formolv1alpha1.Failure
 		} else {
@@ -93,11 +126,36 @@ func (r *RestoreSessionReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		}
 	case formolv1alpha1.Running:
 		// Do the restore and move to Waiting once it is done.
+		// The restore Job moves the target to Waiting or Failure. Here we deal with the Job failures.
+		if reason := r.checkRestoreJob(target, clone); reason != "" {
+			r.Log.V(0).Info("The restore Job failed", "reason", reason)
+			newSessionState = formolv1alpha1.Failure
+			notes[REASON_NOTE] = reason
+			break
+		}
+		if clone != nil {
+			// The clone Job will update the SessionState of the target
+			// once it is done with the restore
+			r.Log.V(0).Info("cloning backup", "target", target, "namespace", clone.Namespace)
+			if target.BackupType == formolv1alpha1.JobKind {
+				r.Log.V(0).Info("cannot clone a JobKind target", "target", target)
+				newSessionState = formolv1alpha1.Failure
+			} else if err := r.restoreCloneJob(target, clone); err != nil {
+				r.Log.Error(err, "unable to create the clone job", "target", target)
+				newSessionState = formolv1alpha1.Failure
+			} else if clone.Namespace != restoreSession.Namespace {
+				requeueAfter = CLONE_JOB_POLL_PERIOD
+			}
+			break
+		}
 		// The restore is different if the Backup was an OnlineKind or a JobKind
 		switch target.BackupType {
 		case formolv1alpha1.JobKind:
 			r.Log.V(0).Info("restoring job backup", "target", target)
-			if err := r.restoreJob(target, backupTargetStatus); err != nil {
+			err := r.restoreJob(target, backupTargetStatus)
+			// The restore reports the changes of the owner and the mode of the files in the annotations
+			restoreSession.ObjectMeta = r.restoreSession.ObjectMeta
+			if err != nil {
 				r.Log.Error(err, "unable to restore job", "target", target)
 				newSessionState = formolv1alpha1.Failure
 			} else {
@@ -105,18 +163,38 @@ func (r *RestoreSessionReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 				newSessionState = formolv1alpha1.Success
 			}
 		case formolv1alpha1.OnlineKind:
+			r.Log.V(0).Info("restoring online backup", "target", target)
+			if mode, _ := getOption(&restoreSession, RESTORE_MODE_OPTION, targetName); mode == JOB_RESTORE_MODE {
+				// Leave the Pod template alone. The restore Job will update the SessionState
+				// of the target once it is done with the restore
+				if err := r.restoreVolumesJob(target); err != nil {
+					r.Log.Error(err, "unable to create the restore job", "target", target)
+					newSessionState = formolv1alpha1.Failure
+				}
+				break
+			}
 			// The initContainer will update the SessionState of the target
 			// once it is done with the restore
-			r.Log.V(0).Info("restoring online backup", "target", target)
 			if err := r.restoreInitContainer(target); err != nil {
 				r.Log.Error(err, "unable to create restore initContainer", "target", target)
 				newSessionState = formolv1alpha1.Failure
 			}
+		case formolv1alpha1.SnapshotKind:
+			// The restore Job will update the SessionState of the target
+			// once it is done with the restore
+			r.Log.V(0).Info("restoring snapshot backup", "target", target)
+			if err := r.restoreVolumesJob(target); err != nil {
+				r.Log.Error(err, "unable to create the restore job", "target", target)
+				newSessionState = formolv1alpha1.Failure
+			}
 		}
 	case formolv1alpha1.Finalize:
 		r.Log.V(0).Info("We are done with the restore. Run the finalize steps")
 		// Runs the finalize Steps functions in chroot env
-		if err := r.runFinalizeSteps(target); err != nil {
+		if clone != nil {
+			r.Log.V(0).Info("Cloned the target. Skipping the finalize steps")
+			newSessionState = formolv1alpha1.Success
+		} else if err := r.runFinalizeSteps(target); err != nil {
 			r.Log.Error(err, "unable to run finalize steps")
 			newSessionState = formolv1alpha1.Failure
 		} else {
@@ -129,14 +207,19 @@ func (r *RestoreSessionReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		err := r.Status().Update(ctx, &restoreSession)
 		if err != nil {
 			r.Log.Error(err, "unable to update RestoreSession status")
+			return ctrl.Result{}, err
+		}
+		if err = r.setStatusNotes(&restoreSession, targetName, notes); err != nil {
+			r.Log.Error(err, "unable to report the target status details")
 		}
 		return ctrl.Result{}, err
 	}
-	return ctrl.Result{}, nil
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
 }
 
 func (r *RestoreSessionReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&formolv1alpha1.RestoreSession{}).
+		Owns(&batchv1.Job{}).
 		Complete(r)
 }
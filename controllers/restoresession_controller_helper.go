@@ -2,9 +2,15 @@ package controllers
 
 import (
 	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
-	"os/exec"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"strings"
 )
 
 func (r *RestoreSessionReconciler) restoreInitContainer(target formolv1alpha1.Target) error {
@@ -56,16 +62,331 @@ func (r *RestoreSessionReconciler) restoreInitContainer(target formolv1alpha1.Ta
 	return nil
 }
 
-func (r *RestoreSessionReconciler) restoreJob(target formolv1alpha1.Target, targetStatus formolv1alpha1.TargetStatus) error {
-	cmd := exec.Command(RESTIC_EXEC, "restore", targetStatus.SnapshotId, "--target", "/")
-	// the restic restore command does not support JSON output
-	if output, err := cmd.CombinedOutput(); err != nil {
-		r.Log.Error(err, "unable to restore snapshot", "output", output)
+// Restores the target volumes with a Job.
+// The target is scaled down while the Job restores the volumes.
+// Once it is done with the restore, the Job scales the target back up
+// and changes the restoreTargetStatus to Waiting.
+func (r *RestoreSessionReconciler) restoreVolumesJob(target formolv1alpha1.Target) error {
+	targetObject, targetPodSpec := formolv1alpha1.GetTargetObjects(target.TargetKind)
+	if err := r.Get(r.Context, client.ObjectKey{
+		Namespace: r.backupConf.Namespace,
+		Name:      target.TargetName,
+	}, targetObject); err != nil {
+		r.Log.Error(err, "unable to get target objects", "target", target.TargetName)
+		return err
+	}
+	volumes := targetPodSpec.Volumes
+	paths, vms, err := getTargetVolumeMounts(target, targetPodSpec)
+	if err != nil {
+		r.Log.Error(err, "cannot restore the volumes in a single Job")
+		return err
+	}
+	devices, err := getTargetVolumeDevices(target, targetPodSpec)
+	if err != nil {
+		r.Log.Error(err, "cannot restore the volumes in a single Job")
+		return err
+	}
+	// The Job writes to the volumes
+	for i := range vms {
+		vms[i].ReadOnly = false
+	}
+	if RestoreFromVolumeSnapshots(&r.restoreSession, target.TargetName) {
+		// The Job replaces the PVCs so it must not use them
+		if _, err := r.GetRestorePoints(r.backupConf.Namespace, r.restoreSession.Spec.BackupSessionRef.Ref.Name, target.TargetName); err != nil {
+			r.Log.Error(err, "cannot roll back the volumes")
+			return err
+		}
+		volumes = nil
+		vms = nil
+		devices = nil
+	}
+	restoreContainer := formolv1alpha1.GetSidecar(r.backupConf, target)
+	restoreContainer.Name = formolv1alpha1.RESTORECONTAINER_NAME
+	restoreContainer.VolumeMounts = vms
+	restoreContainer.VolumeDevices = devices
+	if env, err := r.getResticEnv(r.backupConf); err != nil {
+		r.Log.Error(err, "unable to get restic env")
 		return err
+	} else {
+		restoreContainer.Env = append(restoreContainer.Env, env...)
+	}
+	restoreContainer.Env = append(restoreContainer.Env, corev1.EnvVar{
+		Name:  formolv1alpha1.BACKUP_PATHS,
+		Value: strings.Join(paths, string(os.PathListSeparator)),
+	}, corev1.EnvVar{
+		Name:  BACKUP_DEVICES,
+		Value: FormatBackupDevices(devices),
+	})
+	restoreContainer.Args = []string{"restoresession", "start",
+		"--name", r.restoreSession.Name,
+		"--namespace", r.restoreSession.Namespace,
+		"--target-name", target.TargetName,
+	}
+	job := batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: r.backupConf.Namespace,
+			Name:      r.restoreJobName(target),
+		},
+		Spec: batchv1.JobSpec{
+			TTLSecondsAfterFinished: func() *int32 { ttl := JOBTTL; return &ttl }(),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Volumes: volumes,
+					Containers: []corev1.Container{
+						restoreContainer,
+					},
+					RestartPolicy: corev1.RestartPolicyNever,
+				},
+			},
+		},
+	}
+	if err := controllerutil.SetControllerReference(&r.restoreSession, &job, r.Scheme); err != nil {
+		r.Log.Error(err, "unable to set the restore job owner", "job", job.Name)
+		return err
+	}
+	if err := r.Create(r.Context, &job); err != nil && !errors.IsAlreadyExists(err) {
+		r.Log.Error(err, "unable to create the restore job", "job", job.Name)
+		return err
+	}
+	r.Log.V(0).Info("restore job created", "job", job.Name)
+	// This will kill this Pod. The Job Pod starts once the volumes are released.
+	return r.scaleDownTarget(&r.restoreSession, targetObject, target.TargetName)
+}
+
+// The name of the Job restoring the volumes of the target or cloning them
+func (r *RestoreSessionReconciler) restoreJobName(target formolv1alpha1.Target) string {
+	return jobName("restore", r.Name, target.TargetName)
+}
+
+// Checks whether the Job restoring the target failed. Returns the reason of the failure.
+// The Job does not exist when the restore is done by an initContainer or has not started yet.
+func (r *RestoreSessionReconciler) checkRestoreJob(target formolv1alpha1.Target, clone *CloneTarget) string {
+	namespace := r.backupConf.Namespace
+	if clone != nil {
+		namespace = clone.Namespace
+	}
+	job := batchv1.Job{}
+	if err := r.Get(r.Context, client.ObjectKey{
+		Namespace: namespace,
+		Name:      r.restoreJobName(target),
+	}, &job); err != nil {
+		if !errors.IsNotFound(err) {
+			r.Log.Error(err, "unable to get the restore job", "job", r.restoreJobName(target))
+		}
+		return ""
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			// BackoffLimitExceeded, DeadlineExceeded, ...
+			return condition.Reason + ": " + condition.Message
+		}
+	}
+	return ""
+}
+
+// Restores the target snapshot in the volumes of another workload or in a new PVC.
+// The target itself is left alone.
+// Once it is done with the restore, the Job changes the restoreTargetStatus to Waiting.
+func (r *RestoreSessionReconciler) restoreCloneJob(target formolv1alpha1.Target, clone *CloneTarget) error {
+	restoreContainer := formolv1alpha1.GetSidecar(r.backupConf, target)
+	restoreContainer.Name = formolv1alpha1.RESTORECONTAINER_NAME
+	var volumes []corev1.Volume
+	var cloneObject client.Object
+	if clone.Name != "" {
+		var clonePodSpec *corev1.PodSpec
+		cloneObject, clonePodSpec = formolv1alpha1.GetTargetObjects(clone.Kind)
+		if err := r.Get(r.Context, client.ObjectKey{
+			Namespace: clone.Namespace,
+			Name:      clone.Name,
+		}, cloneObject); err != nil {
+			r.Log.Error(err, "unable to get the clone workload", "namespace", clone.Namespace, "name", clone.Name)
+			return err
+		}
+		volumes = clonePodSpec.Volumes
+		restoreContainer.VolumeMounts = getPodVolumeMounts(clonePodSpec)
+		// The images of the raw block volumes are written to the devices of the clone
+		devices, err := getTargetVolumeDevices(target, clonePodSpec)
+		if err != nil {
+			r.Log.Error(err, "unable to get the clone devices", "namespace", clone.Namespace, "name", clone.Name)
+			return err
+		}
+		restoreContainer.VolumeDevices = devices
+		restoreContainer.Env = append(restoreContainer.Env, corev1.EnvVar{
+			Name:  BACKUP_DEVICES,
+			Value: FormatBackupDevices(devices),
+		})
+	} else {
+		if err := r.createClonePVC(clone); err != nil {
+			return err
+		}
+		volumes = []corev1.Volume{
+			{
+				Name: CLONE_VOLUME_NAME,
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: clone.PVC,
+					},
+				},
+			},
+		}
+		restoreContainer.VolumeMounts = []corev1.VolumeMount{
+			{
+				Name:      CLONE_VOLUME_NAME,
+				MountPath: CLONE_MOUNT_PATH,
+			},
+		}
 	}
+	if env, err := r.getResticEnv(r.backupConf); err != nil {
+		r.Log.Error(err, "unable to get restic env")
+		return err
+	} else {
+		restoreContainer.Env = append(restoreContainer.Env, env...)
+	}
+	restoreContainer.Args = []string{"restoresession", "start",
+		"--name", r.restoreSession.Name,
+		"--namespace", r.restoreSession.Namespace,
+		"--target-name", target.TargetName,
+	}
+	job := batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: clone.Namespace,
+			Name:      r.restoreJobName(target),
+		},
+		Spec: batchv1.JobSpec{
+			TTLSecondsAfterFinished: func() *int32 { ttl := JOBTTL; return &ttl }(),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Volumes: volumes,
+					Containers: []corev1.Container{
+						restoreContainer,
+					},
+					RestartPolicy: corev1.RestartPolicyNever,
+				},
+			},
+		},
+	}
+	// The owner must be in the same namespace
+	if clone.Namespace == r.restoreSession.Namespace {
+		if err := controllerutil.SetControllerReference(&r.restoreSession, &job, r.Scheme); err != nil {
+			r.Log.Error(err, "unable to set the restore job owner", "job", job.Name)
+			return err
+		}
+	}
+	if err := r.Create(r.Context, &job); err != nil && !errors.IsAlreadyExists(err) {
+		r.Log.Error(err, "unable to create the restore job", "job", job.Name)
+		return err
+	}
+	r.Log.V(0).Info("clone job created", "namespace", job.Namespace, "job", job.Name)
+	if cloneObject != nil {
+		// The Job Pod starts once the clone workload has released its volumes
+		return r.scaleDownTarget(&r.restoreSession, cloneObject, target.TargetName)
+	}
+	return nil
+}
+
+// Creates the PVC receiving the clone of the target
+func (r *RestoreSessionReconciler) createClonePVC(clone *CloneTarget) error {
+	pvc := corev1.PersistentVolumeClaim{}
+	if err := r.Get(r.Context, client.ObjectKey{
+		Namespace: clone.Namespace,
+		Name:      clone.PVC,
+	}, &pvc); err == nil {
+		r.Log.V(0).Info("clone pvc already exists", "namespace", clone.Namespace, "pvc", clone.PVC)
+		return nil
+	} else if !errors.IsNotFound(err) {
+		r.Log.Error(err, "unable to get the clone pvc", "namespace", clone.Namespace, "pvc", clone.PVC)
+		return err
+	}
+	size, err := resource.ParseQuantity(clone.PVCSize)
+	if err != nil {
+		r.Log.Error(err, "invalid clone pvc size. Set the clone-pvc-size option", "size", clone.PVCSize)
+		return err
+	}
+	pvc = corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: clone.Namespace,
+			Name:      clone.PVC,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: size,
+				},
+			},
+		},
+	}
+	if clone.StorageClass != "" {
+		pvc.Spec.StorageClassName = &clone.StorageClass
+	}
+	if err := r.Create(r.Context, &pvc); err != nil {
+		r.Log.Error(err, "unable to create the clone pvc", "namespace", clone.Namespace, "pvc", clone.PVC)
+		return err
+	}
+	return nil
+}
+
+func (r *RestoreSessionReconciler) restoreJob(target formolv1alpha1.Target, targetStatus formolv1alpha1.TargetStatus) error {
+	tags := r.getSnapshotTags(targetStatus.SnapshotId)
+	// The snapshots of the streamed Functions
+	streams := getTagValues(tags, STREAM_TAG_PREFIX)
+	// The file names the Functions were streamed as when the snapshot was taken
+	streamedFunctions := getTagValues(tags, STREAM_FUNCTION_TAG_PREFIX)
+	restoreSharePath := false
 	for _, container := range target.Containers {
+		streamed := 0
 		for _, job := range container.Job {
-			if err := r.runFunction(*job.Restore); err != nil {
+			if _, found := streamedFunctions[*job.Backup]; found {
+				streamed++
+			}
+		}
+		if len(container.Job) == 0 || streamed < len(container.Job) {
+			restoreSharePath = true
+		}
+	}
+	restoreOptions := GetRestoreOptions(&r.restoreSession, target.TargetName)
+	if restoreSharePath && restoreOptions.PerPath() {
+		// The restore strategy and the path map apply to the files of the share path
+		if err := r.RestoreSnapshot(targetStatus.SnapshotId, restoreOptions); err != nil {
+			r.Log.Error(err, "unable to restore snapshot", "options", restoreOptions)
+			return err
+		}
+	} else if restoreSharePath {
+		cmd := ResticCommand("restore", targetStatus.SnapshotId, "--target", "/")
+		// the restic restore command does not support JSON output
+		if output, err := cmd.CombinedOutput(); err != nil {
+			r.Log.Error(err, "unable to restore snapshot", "output", output)
+			return err
+		}
+	}
+	if restoreSharePath {
+		// The restore Functions get the files with their new owner and mode
+		if err := r.RemapRestoredFiles(&r.restoreSession, target.TargetName, targetStatus.SnapshotId, restoreOptions); err != nil {
+			return err
+		}
+	}
+	for _, container := range target.Containers {
+		contextVars := r.getContextVars(container, RESTORE_PHASE)
+		for _, job := range container.Job {
+			filename, found := streamedFunctions[*job.Backup]
+			if !found {
+				if err := r.runFunction(*job.Restore, contextVars); err != nil {
+					r.Log.Error(err, "unable to run restore job")
+					return err
+				}
+				continue
+			}
+			// The backup was streamed. Stream it back to the restore Function
+			snapshotId, found := streams[filename]
+			if !found {
+				// This is the last streamed snapshot
+				snapshotId = targetStatus.SnapshotId
+			}
+			function, env, err := r.getFunction(*job.Restore, contextVars)
+			if err != nil {
+				return err
+			}
+			if err := r.restoreFunctionStdin(function, env, snapshotId, filename); err != nil {
 				r.Log.Error(err, "unable to run restore job")
 				return err
 			}
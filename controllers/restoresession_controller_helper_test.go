@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"testing"
+
+	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCheckRestoreJob(t *testing.T) {
+	target := formolv1alpha1.Target{TargetName: "web"}
+	name := jobName("restore", "restoresession-1", target.TargetName)
+	// The clone Job in another namespace failed. The Job of the target is still running.
+	failed := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "clone", Name: name},
+		Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{{
+			Type:    batchv1.JobFailed,
+			Status:  corev1.ConditionTrue,
+			Reason:  "BackoffLimitExceeded",
+			Message: "Job has reached the specified backoff limit",
+		}}},
+	}
+	running := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+	tests := []struct {
+		name  string
+		clone *CloneTarget
+		want  string
+	}{
+		{name: "job of the target", want: ""},
+		{name: "clone job in another namespace", clone: &CloneTarget{Namespace: "clone"}, want: "BackoffLimitExceeded: Job has reached the specified backoff limit"},
+		{name: "clone job not created yet", clone: &CloneTarget{Namespace: "other"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RestoreSessionReconciler{Session: fakeClientSession(failed, running)}
+			r.Name = "restoresession-1"
+			r.backupConf.Namespace = "default"
+			if got := r.checkRestoreJob(target, tt.clone); got != tt.want {
+				t.Errorf("checkRestoreJob() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
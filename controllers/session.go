@@ -8,18 +8,23 @@ import (
 	"fmt"
 	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
 	"github.com/go-logr/logr"
+	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"golang.org/x/sys/unix"
 	"io"
 	"io/fs"
 	"io/ioutil"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 type Session struct {
@@ -29,6 +34,11 @@ type Session struct {
 	Scheme    *runtime.Scheme
 	Namespace string
 	Name      string
+	// Key/value outputs emitted by the Functions. They are made available
+	// to the following Functions and tag the restic snapshot.
+	Outputs map[string]string
+	// Standard formol variables passed to every Function
+	Vars map[string]string
 }
 
 type BackupResult struct {
@@ -36,8 +46,82 @@ type BackupResult struct {
 	Duration   float64
 }
 
+// The restic binary. A variable so the tests can run a fake restic.
+var RESTIC_EXEC = "/usr/bin/restic"
+
+const (
+	// restic upload and download limits in KiB/s
+	FORMOL_LIMIT_UPLOAD   = "FORMOL_LIMIT_UPLOAD"
+	FORMOL_LIMIT_DOWNLOAD = "FORMOL_LIMIT_DOWNLOAD"
+	// restic nice value and ionice class and level
+	FORMOL_NICE         = "FORMOL_NICE"
+	FORMOL_IONICE_CLASS = "FORMOL_IONICE_CLASS"
+	FORMOL_IONICE_LEVEL = "FORMOL_IONICE_LEVEL"
+	// A Function emits an output by printing a line like
+	// FORMOL_OUTPUT KEY=VALUE
+	FUNCTION_OUTPUT = "FORMOL_OUTPUT"
+	// Prefix of the restic tags used to store the Function outputs in the snapshot
+	OUTPUT_TAG_PREFIX = "output:"
+	// Prefix of the annotation used to store the Function outputs of a target in the session
+	OUTPUTS_ANNOTATION = "formol.desmojim.fr/outputs."
+	// The outputs are stored in an annotation and the annotations of an object are limited to 256KiB.
+	// Bigger outputs are dropped.
+	MAX_OUTPUT_SIZE  = 4 * 1024
+	MAX_OUTPUTS_SIZE = 32 * 1024
+	// Annotation of a backup Function streaming its stdout into restic backup --stdin.
+	// The value is the file name of the stream in the snapshot.
+	STREAM_ANNOTATION = "formol.desmojim.fr/stdin-filename"
+	// Prefix of the restic tags referencing the snapshots of the other streamed Functions
+	STREAM_TAG_PREFIX = "stream:"
+	// Tag recording the file name the backup Function stdout was streamed as: stream-function:<function>=<file name>
+	STREAM_FUNCTION_TAG_PREFIX = "stream-function:"
+	// Tag chaining the images of the raw block volumes: device:<volume>=<snapshot id>
+	DEVICE_TAG_PREFIX = "device:"
+	// Tag of the snapshot holding the image of a raw block volume: image:<volume>=<file name>
+	IMAGE_TAG_PREFIX = "image:"
+	// Tag recording where the volumes were mounted: volume:<volume>[/<subpath>]=<mount path>
+	VOLUME_TAG_PREFIX = "volume:"
+	// Raw block volumes backed up by the snapshot Job: <volume>=<device path>:...
+	BACKUP_DEVICES = "FORMOL_BACKUP_DEVICES"
+	// Where the staged restore puts the restored files and the existing ones
+	STAGING_DIR = ".formol-staging"
+	OLD_DIR     = ".formol-old"
+	// Written in the target once the staged restore swapped all the files
+	SWAPPED_MARKER = ".formol-swapped"
+	// Prefix of the annotations reporting details about the target status
+	STATUS_ANNOTATION_PREFIX = "status.formol.desmojim.fr/"
+	// Why the target failed
+	REASON_NOTE = "reason"
+	// The errors reported by the VolumeSnapshots
+	SNAPSHOT_ERROR_NOTE = "snapshot-error"
+)
+
+// Standard variables injected in every Function
 const (
-	RESTIC_EXEC = "/usr/bin/restic"
+	// The Function outputs cannot override them
+	FORMOL_VARS_PREFIX    = "FORMOL_"
+	FORMOL_SESSION_KIND   = "FORMOL_SESSION_KIND"
+	FORMOL_SESSION_NAME   = "FORMOL_SESSION_NAME"
+	FORMOL_NAMESPACE      = "FORMOL_NAMESPACE"
+	FORMOL_TARGET_NAME    = "FORMOL_TARGET_NAME"
+	FORMOL_CONTAINER_NAME = "FORMOL_CONTAINER_NAME"
+	FORMOL_SHARE_PATH     = "FORMOL_SHARE_PATH"
+	FORMOL_BACKUP_PATHS   = "FORMOL_BACKUP_PATHS"
+	FORMOL_PHASE          = "FORMOL_PHASE"
+	FORMOL_SNAPSHOT_ID    = "FORMOL_SNAPSHOT_ID"
+	FORMOL_BACKUP_TIME    = "FORMOL_BACKUP_TIME"
+)
+
+// The phases a Function can run in
+const (
+	INITIALIZE_PHASE = "initialize"
+	FINALIZE_PHASE   = "finalize"
+	BACKUP_PHASE     = "backup"
+	RESTORE_PHASE    = "restore"
+)
+
+var (
+	functionOutput = regexp.MustCompile(`^` + FUNCTION_OUTPUT + `\s+(\w+)=(.*)$`)
 )
 
 func (s Session) getResticEnv(backupConf formolv1alpha1.BackupConfiguration) (envs []corev1.EnvVar, err error) {
@@ -73,11 +157,68 @@ func (s Session) getResticEnv(backupConf formolv1alpha1.BackupConfiguration) (en
 			Value: string(data[formolv1alpha1.RESTIC_PASSWORD]),
 		})
 	}
+	envs = append(envs, getResticLimitsEnv(repo, backupConf)...)
+	return
+}
+
+// Gets the bandwidth limits and the priorities of restic
+// from the BackupConfiguration annotations or the Repo annotations
+func getResticLimitsEnv(repo formolv1alpha1.Repo, backupConf formolv1alpha1.BackupConfiguration) (envs []corev1.EnvVar) {
+	targetName := os.Getenv(formolv1alpha1.TARGET_NAME)
+	for _, option := range []struct {
+		name string
+		env  string
+	}{
+		{LIMIT_UPLOAD_OPTION, FORMOL_LIMIT_UPLOAD},
+		{LIMIT_DOWNLOAD_OPTION, FORMOL_LIMIT_DOWNLOAD},
+		{NICE_OPTION, FORMOL_NICE},
+		{IONICE_CLASS_OPTION, FORMOL_IONICE_CLASS},
+		{IONICE_LEVEL_OPTION, FORMOL_IONICE_LEVEL},
+	} {
+		value, found := getOption(&backupConf, option.name, targetName)
+		if !found {
+			value, found = getOption(&repo, option.name, targetName)
+		}
+		if found {
+			envs = append(envs, corev1.EnvVar{
+				Name:  option.env,
+				Value: value,
+			})
+		}
+	}
 	return
 }
 
+// Builds the restic command with the bandwidth limits
+// and the priorities found in the environment
+func ResticCommand(args ...string) *exec.Cmd {
+	globalArgs := []string{}
+	if limit := os.Getenv(FORMOL_LIMIT_UPLOAD); limit != "" {
+		globalArgs = append(globalArgs, "--limit-upload", limit)
+	}
+	if limit := os.Getenv(FORMOL_LIMIT_DOWNLOAD); limit != "" {
+		globalArgs = append(globalArgs, "--limit-download", limit)
+	}
+	command := append([]string{RESTIC_EXEC}, append(globalArgs, args...)...)
+	if class := os.Getenv(FORMOL_IONICE_CLASS); class != "" {
+		ionice := []string{"ionice", "-c", class}
+		if level := os.Getenv(FORMOL_IONICE_LEVEL); level != "" {
+			ionice = append(ionice, "-n", level)
+		}
+		command = append(ionice, command...)
+	}
+	if nice := os.Getenv(FORMOL_NICE); nice != "" {
+		command = append([]string{"nice", "-n", nice}, command...)
+	}
+	return exec.Command(command[0], command[1:]...)
+}
+
 func (s Session) SetResticEnv(backupConf formolv1alpha1.BackupConfiguration) error {
 	envs, err := s.getResticEnv(backupConf)
+	// The limits might have been removed since the last time
+	for _, name := range []string{FORMOL_LIMIT_UPLOAD, FORMOL_LIMIT_DOWNLOAD, FORMOL_NICE, FORMOL_IONICE_CLASS, FORMOL_IONICE_LEVEL} {
+		os.Unsetenv(name)
+	}
 	for _, env := range envs {
 		os.Setenv(env.Name, env.Value)
 	}
@@ -86,13 +227,13 @@ func (s Session) SetResticEnv(backupConf formolv1alpha1.BackupConfiguration) err
 
 func (s Session) CheckRepo() error {
 	s.Log.V(0).Info("Checking repo")
-	if err := exec.Command(RESTIC_EXEC, "unlock").Run(); err != nil {
+	if err := ResticCommand("unlock").Run(); err != nil {
 		s.Log.Error(err, "unable to unlock repo", "repo", os.Getenv(formolv1alpha1.RESTIC_REPOSITORY))
 	}
-	output, err := exec.Command(RESTIC_EXEC, "check").CombinedOutput()
+	output, err := ResticCommand("check").CombinedOutput()
 	if err != nil {
 		s.Log.V(0).Info("Initializing new repo")
-		output, err = exec.Command(RESTIC_EXEC, "init").CombinedOutput()
+		output, err = ResticCommand("init").CombinedOutput()
 		if err != nil {
 			s.Log.Error(err, "something went wrong during repo init", "output", output)
 		}
@@ -100,13 +241,191 @@ func (s Session) CheckRepo() error {
 	return err
 }
 
-func (s Session) BackupPaths(paths []string) (result BackupResult, err error) {
+func (s Session) BackupPaths(paths []string, options BackupOptions) (result BackupResult, err error) {
 	if err = s.CheckRepo(); err != nil {
 		s.Log.Error(err, "unable to setup repo", "repo", os.Getenv(formolv1alpha1.RESTIC_REPOSITORY))
 		return
 	}
-	s.Log.V(0).Info("backing up paths", "paths", paths)
-	cmd := exec.Command(RESTIC_EXEC, append([]string{"backup", "--json", "--tag", s.Name}, paths...)...)
+	s.Log.V(0).Info("backing up paths", "paths", paths, "options", options)
+	args := append(s.backupArgs(options), options.filterArgs()...)
+	cmd := ResticCommand(append(args, paths...)...)
+	return s.runBackup(cmd)
+}
+
+// Backs up the stdout of the Function with restic backup --stdin
+func (s Session) backupFunctionStdout(function formolv1alpha1.Function, env []string, filename string, options BackupOptions) (result BackupResult, err error) {
+	if err = s.CheckRepo(); err != nil {
+		s.Log.Error(err, "unable to setup repo", "repo", os.Getenv(formolv1alpha1.RESTIC_REPOSITORY))
+		return
+	}
+	s.Log.V(0).Info("backing up Function stdout", "Function", function.Name, "filename", filename, "options", options)
+	functionCmd, err := s.chrootCommand(env, function.Spec.Command[0], function.Spec.Args...)
+	if err != nil {
+		return
+	}
+	cmd := ResticCommand(append(s.backupArgs(options), "--stdin", "--stdin-filename", filename)...)
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	functionCmd.Stdout = writer
+	cmd.Stdin = reader
+	var functionStderr bytes.Buffer
+	functionCmd.Stderr = &functionStderr
+	if err = functionCmd.Start(); err != nil {
+		reader.Close()
+		writer.Close()
+		s.Log.Error(err, "unable to start Function", "Function", function.Name)
+		return
+	}
+	// The Function and restic hold their own copy of the pipe
+	writer.Close()
+	result, err = s.runBackup(cmd)
+	reader.Close()
+	functionErr := functionCmd.Wait()
+	s.scanOutputs(&functionStderr)
+	if functionErr != nil {
+		s.Log.Error(functionErr, "Function failed", "Function", function.Name)
+		return result, functionErr
+	}
+	return
+}
+
+// Pipes the file backed up with restic backup --stdin into the stdin of the Function
+func (s Session) restoreFunctionStdin(function formolv1alpha1.Function, env []string, snapshotId string, filename string) error {
+	s.Log.V(0).Info("restoring Function stdin", "Function", function.Name, "snapshotId", snapshotId, "filename", filename)
+	functionCmd, err := s.chrootCommand(env, function.Spec.Command[0], function.Spec.Args...)
+	if err != nil {
+		return err
+	}
+	cmd := ResticCommand("dump", snapshotId, "/"+filename)
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = writer
+	functionCmd.Stdin = reader
+	var functionOutput, resticStderr bytes.Buffer
+	functionCmd.Stdout = &functionOutput
+	functionCmd.Stderr = &functionOutput
+	cmd.Stderr = &resticStderr
+	if err := functionCmd.Start(); err != nil {
+		reader.Close()
+		writer.Close()
+		s.Log.Error(err, "unable to start Function", "Function", function.Name)
+		return err
+	}
+	// Only the Function reads the pipe. restic gets EPIPE if the Function exits early.
+	reader.Close()
+	resticErr := cmd.Run()
+	writer.Close()
+	functionErr := functionCmd.Wait()
+	s.scanOutputs(&functionOutput)
+	if resticErr != nil {
+		s.Log.Error(resticErr, "unable to dump the file", "filename", filename, "stderr", resticStderr.String())
+		return resticErr
+	}
+	if functionErr != nil {
+		s.Log.Error(functionErr, "Function failed", "Function", function.Name)
+		return functionErr
+	}
+	return nil
+}
+
+// The name of the image of the raw block volume in the restic snapshot
+func deviceFilename(device corev1.VolumeDevice) string {
+	return device.Name + ".img"
+}
+
+// Formats the raw block volumes for the BACKUP_DEVICES env variable
+func FormatBackupDevices(devices []corev1.VolumeDevice) string {
+	values := []string{}
+	for _, device := range devices {
+		values = append(values, device.Name+"="+device.DevicePath)
+	}
+	return strings.Join(values, string(os.PathListSeparator))
+}
+
+// Gets the raw block volumes from the BACKUP_DEVICES env variable
+func GetBackupDevices() (devices []corev1.VolumeDevice) {
+	for _, value := range strings.Split(os.Getenv(BACKUP_DEVICES), string(os.PathListSeparator)) {
+		if name, path, found := strings.Cut(value, "="); found {
+			devices = append(devices, corev1.VolumeDevice{
+				Name:       name,
+				DevicePath: path,
+			})
+		}
+	}
+	return
+}
+
+// Backs up the image of the raw block volume with restic backup --stdin
+func (s Session) BackupDevice(device corev1.VolumeDevice, options BackupOptions) (result BackupResult, err error) {
+	if err = s.CheckRepo(); err != nil {
+		s.Log.Error(err, "unable to setup repo", "repo", os.Getenv(formolv1alpha1.RESTIC_REPOSITORY))
+		return
+	}
+	s.Log.V(0).Info("backing up device", "device", device.DevicePath, "options", options)
+	file, err := os.Open(device.DevicePath)
+	if err != nil {
+		s.Log.Error(err, "unable to open the device", "device", device.DevicePath)
+		return
+	}
+	defer file.Close()
+	cmd := ResticCommand(append(s.backupArgs(options),
+		"--tag", IMAGE_TAG_PREFIX+device.Name+"="+deviceFilename(device),
+		"--stdin", "--stdin-filename", deviceFilename(device))...)
+	cmd.Stdin = file
+	return s.runBackup(cmd)
+}
+
+// Writes the images of the raw block volumes back to the devices with restic dump.
+// The snapshot ids of the images are in the device: tags of the snapshot.
+// The devices without an image in the backup are left untouched.
+func (s Session) RestoreDevices(devices []corev1.VolumeDevice, snapshotId string) error {
+	images := s.getDeviceImages(snapshotId)
+	for _, device := range devices {
+		imageId, found := images[device.Name]
+		if !found {
+			s.Log.V(0).Info("no image of the device in the snapshot. Skipping", "device", device.Name, "snapshotId", snapshotId)
+			continue
+		}
+		s.Log.V(0).Info("restoring device", "device", device.DevicePath, "snapshotId", imageId)
+		file, err := os.OpenFile(device.DevicePath, os.O_WRONLY, 0)
+		if err != nil {
+			s.Log.Error(err, "unable to open the device", "device", device.DevicePath)
+			return err
+		}
+		cmd := ResticCommand("dump", imageId, "/"+deviceFilename(device))
+		cmd.Stdout = file
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		err = cmd.Run()
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+		if err != nil {
+			s.Log.Error(err, "unable to restore the device", "device", device.DevicePath, "stderr", stderr.String())
+			return err
+		}
+	}
+	return nil
+}
+
+func (s Session) backupArgs(options BackupOptions) []string {
+	args := []string{"backup", "--json", "--tag", s.Name}
+	for _, tag := range options.Tags {
+		args = append(args, "--tag", tag)
+	}
+	if options.Host != "" {
+		args = append(args, "--host", options.Host)
+	}
+	return args
+}
+
+// Runs the restic backup command and parses its JSON output
+func (s Session) runBackup(cmd *exec.Cmd) (result BackupResult, err error) {
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 	_ = cmd.Start()
@@ -132,6 +451,442 @@ func (s Session) BackupPaths(paths []string) (result BackupResult, err error) {
 	return
 }
 
+// Returns the Function outputs as restic tags
+func (s Session) OutputTags() (tags []string) {
+	for key, value := range s.Outputs {
+		// restic splits the --tag values on commas
+		if strings.Contains(value, ",") {
+			s.Log.V(0).Info("output value contains a comma. Not adding it to the snapshot tags", "key", key)
+			continue
+		}
+		tags = append(tags, OUTPUT_TAG_PREFIX+key+"="+value)
+	}
+	return
+}
+
+// Gets the Function outputs of a target previously saved in the session annotations
+func GetOutputs(obj client.Object, targetName string) map[string]string {
+	outputs := make(map[string]string)
+	if data, ok := obj.GetAnnotations()[OUTPUTS_ANNOTATION+targetName]; ok {
+		_ = json.Unmarshal([]byte(data), &outputs)
+	}
+	return outputs
+}
+
+// Saves the Function outputs of a target in the session annotations
+// so they are still available in the next states
+func (s Session) saveOutputs(obj client.Object, targetName string) error {
+	if len(s.Outputs) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(s.Outputs)
+	if err != nil {
+		return err
+	}
+	return s.patchAnnotations(obj, map[string]string{
+		OUTPUTS_ANNOTATION + targetName: string(data),
+	})
+}
+
+// Reports details about the target status in the session annotations.
+// The notes are stored as status.formol.desmojim.fr/<note>.<target>
+func (s Session) setStatusNotes(obj client.Object, targetName string, notes map[string]string) error {
+	if len(notes) == 0 {
+		return nil
+	}
+	annotations := make(map[string]string)
+	for note, value := range notes {
+		key := STATUS_ANNOTATION_PREFIX + note + "." + targetName
+		// Don't update the object, and trigger a new reconcile, for nothing
+		if current, found := obj.GetAnnotations()[key]; !found || current != value {
+			annotations[key] = value
+		}
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+	return s.patchAnnotations(obj, annotations)
+}
+
+// Gets a note about the target status from the session annotations
+func GetStatusNote(obj client.Object, targetName string, note string) string {
+	return obj.GetAnnotations()[STATUS_ANNOTATION_PREFIX+note+"."+targetName]
+}
+
+// Adds the given annotations to the object
+func (s Session) patchAnnotations(obj client.Object, newAnnotations map[string]string) error {
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	for key, value := range newAnnotations {
+		annotations[key] = value
+	}
+	obj.SetAnnotations(annotations)
+	return s.Patch(s.Context, obj, patch)
+}
+
+// Gets the tags of a restic snapshot
+func (s Session) getSnapshotTags(snapshotId string) (tags []string) {
+	output, err := ResticCommand("snapshots", "--json", snapshotId).Output()
+	if err != nil {
+		s.Log.Error(err, "unable to get the snapshot", "snapshotId", snapshotId)
+		return
+	}
+	var snapshots []struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.Unmarshal(output, &snapshots); err != nil {
+		s.Log.Error(err, "unable to unmarshal json", "data", string(output))
+		return
+	}
+	for _, snapshot := range snapshots {
+		tags = append(tags, snapshot.Tags...)
+	}
+	return
+}
+
+// Gets the paths backed up in a restic snapshot
+func (s Session) getSnapshotPaths(snapshotId string) (paths []string, err error) {
+	output, err := ResticCommand("snapshots", "--json", snapshotId).Output()
+	if err != nil {
+		s.Log.Error(err, "unable to get the snapshot", "snapshotId", snapshotId)
+		return
+	}
+	var snapshots []struct {
+		Paths []string `json:"paths"`
+	}
+	if err = json.Unmarshal(output, &snapshots); err != nil {
+		s.Log.Error(err, "unable to unmarshal json", "data", string(output))
+		return
+	}
+	for _, snapshot := range snapshots {
+		paths = append(paths, snapshot.Paths...)
+	}
+	return
+}
+
+// Restores every path of the snapshot to the path given by the path map under the root
+func (s Session) RestoreSnapshot(snapshotId string, options RestoreOptions) error {
+	paths, err := s.getSnapshotPaths(snapshotId)
+	if err != nil {
+		return err
+	}
+	if len(getTagValues(s.getSnapshotTags(snapshotId), IMAGE_TAG_PREFIX)) > 0 {
+		// The snapshot only holds the image of a raw block volume. See RestoreDevices
+		s.Log.V(0).Info("no files in the snapshot", "snapshotId", snapshotId)
+		return nil
+	}
+	importRoot := s.getImportRoot(snapshotId)
+	for _, path := range paths {
+		target := options.restorePath(trimImportRoot(path, importRoot))
+		s.Log.V(0).Info("restoring path", "snapshotId", snapshotId, "path", path, "target", target, "strategy", options.Strategy)
+		switch options.Strategy {
+		case OVERWRITE_STRATEGY:
+			err = s.restorePath(snapshotId, path, target)
+		case MIRROR_STRATEGY:
+			// Delete the files that are not in the snapshot
+			err = s.restorePath(snapshotId, path, target, "--delete")
+		case STAGED_STRATEGY:
+			err = s.restorePathStaged(snapshotId, path, target)
+		default:
+			err = fmt.Errorf("unknown restore strategy %s", options.Strategy)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restores the content of the snapshot folder into the target
+func (s Session) restorePath(snapshotId string, path string, target string, args ...string) error {
+	cmd := ResticCommand(append([]string{"restore", snapshotId + ":" + path, "--target", target}, args...)...)
+	// the restic restore command does not support JSON output
+	if output, err := cmd.CombinedOutput(); err != nil {
+		s.Log.Error(err, "unable to restore path", "path", path, "output", string(output))
+		return err
+	}
+	return nil
+}
+
+// Restores the snapshot folder in a staging directory and verifies it.
+// The existing files are then swapped with the restored ones. When the target is not a mount point,
+// the staging directory is a sibling of the target and the two directories are exchanged with
+// a single rename. Otherwise the staging directory is in the target and the swap is done
+// file by file with renames in the target filesystem.
+// The existing files are left untouched if the restore fails.
+func (s Session) restorePathStaged(snapshotId string, path string, target string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		s.Log.Error(err, "unable to create the target", "target", target)
+		return err
+	}
+	// A previous restore stopped in the middle of the swap
+	if err := s.recoverStagedRestore(target); err != nil {
+		return err
+	}
+	mountPoint, err := isMountPoint(target)
+	if err != nil {
+		s.Log.Error(err, "unable to stat the target", "target", target)
+		return err
+	}
+	staging := filepath.Join(target, STAGING_DIR)
+	if !mountPoint {
+		staging = siblingStagingDir(target)
+	}
+	if err := s.restorePath(snapshotId, path, staging, "--verify"); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	if !mountPoint {
+		err := exchangeDirs(staging, target)
+		if err == nil {
+			// The staging directory holds the old files now
+			if err := os.RemoveAll(staging); err != nil {
+				s.Log.Error(err, "unable to remove the old files", "dir", staging)
+			}
+			return nil
+		}
+		if err != unix.EINVAL && err != unix.ENOSYS && err != unix.EXDEV {
+			s.Log.Error(err, "unable to swap the restored files", "target", target)
+			os.RemoveAll(staging)
+			return err
+		}
+		s.Log.V(0).Info("the filesystem cannot exchange the directories. Swapping the files one by one", "target", target)
+	}
+	return s.swapStagedFiles(target, staging)
+}
+
+// Swaps the files of the target with the restored files of the staging directory one by one.
+// The swap is undone if a rename fails.
+func (s Session) swapStagedFiles(target string, staging string) error {
+	old := filepath.Join(target, OLD_DIR)
+	if err := os.Mkdir(old, 0700); err != nil {
+		s.Log.Error(err, "unable to create the directory of the old files", "dir", old)
+		return err
+	}
+	// Moves the entries of the from directory to the to directory
+	move := func(from string, to string) (moved []string, err error) {
+		entries, err := os.ReadDir(from)
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			if from == target && isStagedRestoreEntry(entry.Name()) {
+				continue
+			}
+			if err = os.Rename(filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name())); err != nil {
+				return
+			}
+			moved = append(moved, entry.Name())
+		}
+		return
+	}
+	// Moves back the entries after a failed swap
+	undo := func(from string, to string, moved []string) {
+		for _, name := range moved {
+			os.Rename(filepath.Join(from, name), filepath.Join(to, name))
+		}
+	}
+	movedOld, err := move(target, old)
+	if err != nil {
+		s.Log.Error(err, "unable to move the existing files", "target", target)
+		undo(old, target, movedOld)
+		return err
+	}
+	if movedNew, err := move(staging, target); err != nil {
+		s.Log.Error(err, "unable to swap the restored files", "target", target)
+		undo(target, staging, movedNew)
+		undo(old, target, movedOld)
+		return err
+	}
+	// From now on an interrupted restore must not bring the old files back
+	if err := writeMarker(target, SWAPPED_MARKER); err != nil {
+		s.Log.Error(err, "unable to mark the swap as complete", "target", target)
+		return err
+	}
+	return s.cleanupStagedRestore(target)
+}
+
+// Finishes a staged restore interrupted by a crash. The old files are put back
+// if the swap was not complete. Otherwise the cleanup is done again.
+func (s Session) recoverStagedRestore(target string) error {
+	if _, err := os.Lstat(filepath.Join(target, SWAPPED_MARKER)); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if err := s.recoverOldFiles(target, filepath.Join(target, OLD_DIR)); err != nil {
+			return err
+		}
+	}
+	return s.cleanupStagedRestore(target)
+}
+
+// Removes the old files, the staging directories and the marker of a staged restore.
+// The marker goes last.
+func (s Session) cleanupStagedRestore(target string) error {
+	for _, dir := range []string{filepath.Join(target, OLD_DIR), filepath.Join(target, STAGING_DIR), siblingStagingDir(target)} {
+		if err := os.RemoveAll(dir); err != nil {
+			s.Log.Error(err, "unable to clean up", "dir", dir)
+			return err
+		}
+	}
+	if err := os.Remove(filepath.Join(target, SWAPPED_MARKER)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Moves the files saved in the old directory by an interrupted staged restore back to the target.
+// They replace the restored files of the same name. The other restored files are swapped
+// out again by the new restore.
+func (s Session) recoverOldFiles(target string, old string) error {
+	entries, err := os.ReadDir(old)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		s.Log.Error(err, "unable to read the old files", "dir", old)
+		return err
+	}
+	s.Log.V(0).Info("recovering the files of an interrupted restore", "dir", old)
+	for _, entry := range entries {
+		name := filepath.Join(target, entry.Name())
+		if err := os.RemoveAll(name); err != nil {
+			s.Log.Error(err, "unable to remove the restored file", "file", name)
+			return err
+		}
+		if err := os.Rename(filepath.Join(old, entry.Name()), name); err != nil {
+			s.Log.Error(err, "unable to recover the old file", "file", name)
+			return err
+		}
+	}
+	return nil
+}
+
+// The entries of the target that belong to the staged restore
+func isStagedRestoreEntry(name string) bool {
+	return name == STAGING_DIR || name == OLD_DIR || name == SWAPPED_MARKER
+}
+
+// The staging directory next to the target: /data => /.data.formol-staging
+func siblingStagingDir(target string) string {
+	return filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+STAGING_DIR)
+}
+
+// Returns true if the directory is the root of a filesystem
+func isMountPoint(dir string) (bool, error) {
+	dir = filepath.Clean(dir)
+	if dir == filepath.Dir(dir) {
+		return true, nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return false, err
+	}
+	parent, err := os.Stat(filepath.Dir(dir))
+	if err != nil {
+		return false, err
+	}
+	return info.Sys().(*syscall.Stat_t).Dev != parent.Sys().(*syscall.Stat_t).Dev, nil
+}
+
+// Atomically exchanges the restored directory with the target.
+// The restored directory gets the owner and the mode of the target first.
+func exchangeDirs(staging string, target string) error {
+	info, err := os.Lstat(target)
+	if err != nil {
+		return err
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	stagingInfo, err := os.Lstat(staging)
+	if err != nil {
+		return err
+	}
+	if stagingStat := stagingInfo.Sys().(*syscall.Stat_t); stagingStat.Uid != stat.Uid || stagingStat.Gid != stat.Gid {
+		if err := os.Lchown(staging, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+	}
+	// After the chown that clears the setuid and setgid bits
+	if err := os.Chmod(staging, info.Mode()); err != nil {
+		return err
+	}
+	return unix.Renameat2(unix.AT_FDCWD, staging, unix.AT_FDCWD, target, unix.RENAME_EXCHANGE)
+}
+
+// Writes an empty file in the directory and makes sure both are on disk
+func writeMarker(dir string, name string) error {
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Gets the key/value pairs stored in the snapshot tags starting with prefix
+func getTagValues(tags []string, prefix string) map[string]string {
+	values := make(map[string]string)
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			if key, value, found := strings.Cut(strings.TrimPrefix(tag, prefix), "="); found {
+				values[key] = value
+			}
+		}
+	}
+	return values
+}
+
+// Gets the snapshots holding the images of the raw block volumes of the backup: volume => snapshot id.
+// The last image is the snapshot itself.
+func (s Session) getDeviceImages(snapshotId string) map[string]string {
+	tags := s.getSnapshotTags(snapshotId)
+	images := getTagValues(tags, DEVICE_TAG_PREFIX)
+	for name := range getTagValues(tags, IMAGE_TAG_PREFIX) {
+		images[name] = snapshotId
+	}
+	return images
+}
+
+// Gets the snapshots the snapshot references with its stream: and device: tags.
+// They belong to the same backup.
+func (s Session) GetLinkedSnapshots(snapshotId string) []string {
+	return linkedSnapshotIds(snapshotId, s.getSnapshotTags(snapshotId))
+}
+
+// Gets the snapshot ids of the stream: and device: tags of the snapshot
+func linkedSnapshotIds(snapshotId string, tags []string) (snapshotIds []string) {
+	seen := map[string]bool{snapshotId: true}
+	for _, prefix := range []string{STREAM_TAG_PREFIX, DEVICE_TAG_PREFIX} {
+		for _, id := range getTagValues(tags, prefix) {
+			if !seen[id] {
+				seen[id] = true
+				snapshotIds = append(snapshotIds, id)
+			}
+		}
+	}
+	sort.Strings(snapshotIds)
+	return
+}
+
+// Gets the Function outputs stored in the tags of a restic snapshot
+func (s Session) getSnapshotOutputs(snapshotId string) map[string]string {
+	return getTagValues(s.getSnapshotTags(snapshotId), OUTPUT_TAG_PREFIX)
+}
+
 func (s Session) getSecretData(name string) map[string][]byte {
 	secret := corev1.Secret{}
 	if err := s.Get(s.Context, client.ObjectKey{
@@ -214,17 +969,39 @@ func (s Session) getFuncVars(function formolv1alpha1.Function, vars map[string]s
 	s.getFuncEnv(vars, function.Spec.Env)
 }
 
-func (s Session) runFunction(name string) error {
+// Returns the standard variables of a Function running in the given container and phase
+func (s Session) getContextVars(container formolv1alpha1.TargetContainer, phase string) map[string]string {
+	vars := make(map[string]string)
+	for key, value := range s.Vars {
+		vars[key] = value
+	}
+	vars[FORMOL_CONTAINER_NAME] = container.Name
+	vars[FORMOL_SHARE_PATH] = container.SharePath
+	vars[FORMOL_PHASE] = phase
+	return vars
+}
+
+// Gets the Function and resolves its variables.
+// Returns the Function with its arguments expanded and its environment variables.
+func (s Session) getFunction(name string, contextVars map[string]string) (function formolv1alpha1.Function, env []string, err error) {
 	namespace := os.Getenv(formolv1alpha1.POD_NAMESPACE)
-	function := formolv1alpha1.Function{}
-	if err := s.Get(s.Context, client.ObjectKey{
+	if err = s.Get(s.Context, client.ObjectKey{
 		Namespace: namespace,
 		Name:      name,
 	}, &function); err != nil {
 		s.Log.Error(err, "unable to get Function", "Function", name)
-		return err
+		return
 	}
 	vars := make(map[string]string)
+	for key, value := range contextVars {
+		vars[key] = value
+	}
+	// The outputs of the previous Functions are available as variables
+	for key, value := range s.Outputs {
+		if !strings.HasPrefix(key, FORMOL_VARS_PREFIX) {
+			vars[key] = value
+		}
+	}
 	s.getFuncVars(function, vars)
 
 	s.Log.V(0).Info("function vars", "vars", vars)
@@ -238,8 +1015,19 @@ func (s Session) runFunction(name string) error {
 			function.Spec.Args[i] = vars[arg]
 		}
 	}
+	for key, value := range vars {
+		env = append(env, key+"="+value)
+	}
+	return
+}
+
+func (s Session) runFunction(name string, contextVars map[string]string) error {
+	function, env, err := s.getFunction(name, contextVars)
+	if err != nil {
+		return err
+	}
 	s.Log.V(1).Info("about to run Function", "Function", name, "command", function.Spec.Command, "args", function.Spec.Args)
-	if err := s.runTargetContainerChroot(function.Spec.Command[0],
+	if err := s.runTargetContainerChroot(env, function.Spec.Command[0],
 		function.Spec.Args...); err != nil {
 		s.Log.Error(err, "unable to run command", "command", function.Spec.Command)
 		return err
@@ -247,8 +1035,79 @@ func (s Session) runFunction(name string) error {
 	return nil
 }
 
+// Returns the file name the Function stdout is backed up as
+// when the Function streams its backup. Returns "" otherwise.
+func getStreamFilename(function formolv1alpha1.Function) string {
+	return function.Annotations[STREAM_ANNOTATION]
+}
+
+// The size of the outputs except the given one
+func outputsSize(outputs map[string]string, except string) (size int) {
+	for key, value := range outputs {
+		if key != except {
+			size += len(key) + len(value)
+		}
+	}
+	return
+}
+
+// Logs the output of a command and looks for the Function outputs
+func (s Session) scanOutputs(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		if output := functionOutput.FindStringSubmatch(scanner.Text()); output != nil && s.Outputs != nil {
+			key, value := output[1], output[2]
+			if strings.HasPrefix(key, FORMOL_VARS_PREFIX) {
+				s.Log.V(0).Info("output would override a standard variable. Dropping it", "key", key)
+				continue
+			}
+			if len(value) > MAX_OUTPUT_SIZE {
+				s.Log.V(0).Info("output is too big. Dropping it", "key", key, "size", len(value), "max", MAX_OUTPUT_SIZE)
+				continue
+			}
+			if size := outputsSize(s.Outputs, key) + len(key) + len(value); size > MAX_OUTPUTS_SIZE {
+				s.Log.V(0).Info("too many outputs. Dropping it", "key", key, "size", size, "max", MAX_OUTPUTS_SIZE)
+				continue
+			}
+			s.Log.V(0).Info("cmd emitted an output", "key", key)
+			s.Outputs[key] = value
+			continue
+		}
+		s.Log.V(0).Info("cmd output", "output", scanner.Text())
+	}
+}
+
 // Runs the given command in the target container chroot
-func (s Session) runTargetContainerChroot(runCmd string, args ...string) error {
+// with the given environment variables on top of ours
+func (s Session) runTargetContainerChroot(runEnv []string, runCmd string, args ...string) error {
+	cmd, err := s.chrootCommand(runEnv, runCmd, args...)
+	if err != nil {
+		return err
+	}
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+	_ = cmd.Start()
+
+	s.scanOutputs(io.MultiReader(stdout, stderr))
+
+	return cmd.Wait()
+}
+
+// Prepares the command to run in the target container chroot
+func (s Session) chrootCommand(runEnv []string, runCmd string, args ...string) (*exec.Cmd, error) {
+	root, err := s.getTargetContainerRoot()
+	if err != nil {
+		return nil, err
+	}
+	s.Log.V(0).Info("running cmd in chroot", "path", root)
+	cmd := exec.Command("chroot", append([]string{root, runCmd}, args...)...)
+	cmd.Env = append(os.Environ(), runEnv...)
+	return cmd, nil
+}
+
+// Finds the target container process and returns the path to its root
+func (s Session) getTargetContainerRoot() (root string, e error) {
 	env := regexp.MustCompile(`/proc/[0-9]+/environ`)
 	if err := filepath.WalkDir("/proc", func(path string, info fs.DirEntry, err error) error {
 		if err != nil {
@@ -273,50 +1132,79 @@ func (s Session) runTargetContainerChroot(runCmd string, args ...string) error {
 					return err
 				}
 				if matched {
-					// Found the right process. Now run the command in its 'root'
+					// Found the right process. Now we know its 'root'
 					s.Log.V(0).Info("Found the tag", "file", path)
-					root := filepath.Join(filepath.Dir(path), "root")
+					root = filepath.Join(filepath.Dir(path), "root")
 					if _, err := filepath.EvalSymlinks(root); err != nil {
 						s.Log.Error(err, "cannot EvalSymlink.")
 						return err
 					}
-					s.Log.V(0).Info("running cmd in chroot", "path", root)
-					cmd := exec.Command("chroot", append([]string{root, runCmd}, args...)...)
-					stdout, _ := cmd.StdoutPipe()
-					stderr, _ := cmd.StderrPipe()
-					_ = cmd.Start()
-
-					scanner := bufio.NewScanner(io.MultiReader(stdout, stderr))
-					scanner.Split(bufio.ScanLines)
-					for scanner.Scan() {
-						s.Log.V(0).Info("cmd output", "output", scanner.Text())
-					}
-
-					if err := cmd.Wait(); err != nil {
-						return err
-					} else {
-						return filepath.SkipAll
-					}
+					return filepath.SkipAll
 				}
 			}
 		}
 		return nil
 	}); err != nil {
 		s.Log.Error(err, "cannot walk /proc")
+		return "", err
+	}
+	if root == "" {
+		return "", fmt.Errorf("unable to find the target container process")
+	}
+	return
+}
+
+// Deletes the VolumeSnapshots and the PVCs created to backup the target
+func (s Session) DeleteSnapshotVolumes(namespace string, backupSessionName string, targetName string) error {
+	labels := client.MatchingLabels{
+		BACKUPSESSION_LABEL: backupSessionName,
+		TARGET_LABEL:        targetName,
+	}
+	vss := volumesnapshotv1.VolumeSnapshotList{}
+	if err := s.List(s.Context, &vss, client.InNamespace(namespace), labels); err != nil {
+		s.Log.Error(err, "unable to list the volumesnapshots", "backupsession", backupSessionName)
 		return err
 	}
+	for _, vs := range vss.Items {
+		if err := s.Delete(s.Context, &vs); err != nil && !errors.IsNotFound(err) {
+			s.Log.Error(err, "unable to delete volumesnapshot", "vs", vs.Name)
+			return err
+		}
+		s.Log.V(0).Info("volumesnapshot deleted", "vs", vs.Name)
+	}
+	if err := s.deleteGroupSnapshots(namespace, labels); err != nil {
+		return err
+	}
+	return s.deleteBackupPVCs(namespace, labels)
+}
+
+// Deletes the PVCs created from the VolumeSnapshots to run the backup
+func (s Session) deleteBackupPVCs(namespace string, labels client.MatchingLabels) error {
+	pvcs := corev1.PersistentVolumeClaimList{}
+	if err := s.List(s.Context, &pvcs, client.InNamespace(namespace), labels); err != nil {
+		s.Log.Error(err, "unable to list the PVCs", "labels", labels)
+		return err
+	}
+	for _, pvc := range pvcs.Items {
+		if err := s.Delete(s.Context, &pvc); err != nil && !errors.IsNotFound(err) {
+			s.Log.Error(err, "unable to delete PVC", "pvc", pvc.Name)
+			return err
+		}
+		s.Log.V(0).Info("PVC deleted", "pvc", pvc.Name)
+	}
 	return nil
 }
 
 type selectStep func(formolv1alpha1.Step) *string
 
-func (s Session) runSteps(target formolv1alpha1.Target, fn selectStep) error {
+func (s Session) runSteps(target formolv1alpha1.Target, phase string, fn selectStep) error {
 	// For every container listed in the target, run the initialization steps
 	for _, container := range target.Containers {
+		contextVars := s.getContextVars(container, phase)
 		// Runs the steps one after the other
 		for _, step := range container.Steps {
 			if fn(step) != nil {
-				if err := s.runFunction(*fn(step)); err != nil {
+				if err := s.runFunction(*fn(step), contextVars); err != nil {
 					return err
 				}
 			}
@@ -330,7 +1218,7 @@ func (s Session) runSteps(target formolv1alpha1.Target, fn selectStep) error {
 // before actualy doing the backup in the RUNNING state
 func (s Session) runInitializeSteps(target formolv1alpha1.Target) error {
 	s.Log.V(0).Info("start to run the finalize steps it any")
-	return s.runSteps(target, func(step formolv1alpha1.Step) *string {
+	return s.runSteps(target, INITIALIZE_PHASE, func(step formolv1alpha1.Step) *string {
 		return step.Initialize
 	})
 }
@@ -340,7 +1228,7 @@ func (s Session) runInitializeSteps(target formolv1alpha1.Target) error {
 // The finalize happens whatever the result of the backup.
 func (s Session) runFinalizeSteps(target formolv1alpha1.Target) error {
 	s.Log.V(0).Info("start to run the initialize steps it any")
-	return s.runSteps(target, func(step formolv1alpha1.Step) *string {
+	return s.runSteps(target, FINALIZE_PHASE, func(step formolv1alpha1.Step) *string {
 		return step.Finalize
 	})
 }
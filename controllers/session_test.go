@@ -0,0 +1,436 @@
+package controllers
+
+import (
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetTagValues(t *testing.T) {
+	tags := []string{
+		"backupsession-1",
+		STREAM_TAG_PREFIX + "dump.sql=1234abcd",
+		STREAM_TAG_PREFIX + "keys.tar=5678ef01",
+		STREAM_FUNCTION_TAG_PREFIX + "backup-pg=dump.sql",
+		OUTPUT_TAG_PREFIX + "query=a=b",
+		OUTPUT_TAG_PREFIX + "empty=",
+		OUTPUT_TAG_PREFIX + "novalue",
+		DEVICE_TAG_PREFIX + "disk=aaaa",
+		DEVICE_TAG_PREFIX + "disk=bbbb",
+	}
+	tests := []struct {
+		prefix string
+		want   map[string]string
+	}{
+		{prefix: STREAM_TAG_PREFIX, want: map[string]string{"dump.sql": "1234abcd", "keys.tar": "5678ef01"}},
+		{prefix: STREAM_FUNCTION_TAG_PREFIX, want: map[string]string{"backup-pg": "dump.sql"}},
+		// The value can hold '=' and the tags without one are ignored
+		{prefix: OUTPUT_TAG_PREFIX, want: map[string]string{"query": "a=b", "empty": ""}},
+		// The last tag wins
+		{prefix: DEVICE_TAG_PREFIX, want: map[string]string{"disk": "bbbb"}},
+		{prefix: IMPORT_TAG_PREFIX, want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		if got := getTagValues(tags, tt.prefix); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getTagValues(%q) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestScanOutputs(t *testing.T) {
+	s := Session{
+		Log:     logr.Discard(),
+		Outputs: map[string]string{"PREVIOUS": "kept"},
+	}
+	s.scanOutputs(strings.NewReader(strings.Join([]string{
+		"some log line",
+		FUNCTION_OUTPUT + " LSN=0/16B3748",
+		FUNCTION_OUTPUT + " FORMOL_SNAPSHOT_ID=forged",
+		FUNCTION_OUTPUT + " FORMOL_PHASE=backup",
+		FUNCTION_OUTPUT + " BIG=" + strings.Repeat("x", MAX_OUTPUT_SIZE+1),
+		FUNCTION_OUTPUT + " not an output",
+	}, "\n")))
+	want := map[string]string{"PREVIOUS": "kept", "LSN": "0/16B3748"}
+	if !reflect.DeepEqual(s.Outputs, want) {
+		t.Errorf("scanOutputs() outputs = %v, want %v", s.Outputs, want)
+	}
+}
+
+// A fake restic restoring the files of its snapshot directory in the --target directory
+const restoreRestic = `[ "$1" = restore ] || exit 1
+mkdir -p "$4" && cp -R "$FAKE_RESTIC_DIR/snapshot/." "$4/"
+[ -f "$FAKE_RESTIC_DIR/fail" ] && exit 1
+exit 0
+`
+
+// Writes the files in the directory. The / values are directories.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if content == "/" {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Reads the files of the directory. The / values are directories.
+func readFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	if err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		name, _ := filepath.Rel(dir, path)
+		if info.IsDir() {
+			files[name] = "/"
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		files[name] = string(content)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestRestorePathStaged(t *testing.T) {
+	snapshot := map[string]string{"file": "new", "dir": "/", "dir/file": "new"}
+	existing := map[string]string{"file": "old", "stale": "old"}
+	tests := []struct {
+		name string
+		fail bool
+		want map[string]string
+	}{
+		{name: "restore", want: snapshot},
+		{name: "failed restore", fail: true, want: existing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resticDir := fakeRestic(t, restoreRestic)
+			writeFiles(t, filepath.Join(resticDir, "snapshot"), snapshot)
+			if tt.fail {
+				writeFiles(t, resticDir, map[string]string{"fail": ""})
+			}
+			parent := t.TempDir()
+			target := filepath.Join(parent, "data")
+			writeFiles(t, target, existing)
+			if err := os.Chmod(target, 0750); err != nil {
+				t.Fatal(err)
+			}
+			s := Session{Log: logr.Discard()}
+			err := s.restorePathStaged("1234", "/data", target)
+			if tt.fail != (err != nil) {
+				t.Fatalf("restorePathStaged() error = %v, want an error: %v", err, tt.fail)
+			}
+			if got := readFiles(t, target); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("target files = %v, want %v", got, tt.want)
+			}
+			if got := readFiles(t, parent); len(got) != len(tt.want)+1 {
+				t.Errorf("files next to the target = %v, want no leftover", got)
+			}
+			if info, err := os.Stat(target); err != nil || info.Mode().Perm() != 0750 {
+				t.Errorf("target mode = %v, %v, want 0750", info.Mode(), err)
+			}
+		})
+	}
+}
+
+func TestSwapStagedFiles(t *testing.T) {
+	target := t.TempDir()
+	staging := filepath.Join(target, STAGING_DIR)
+	writeFiles(t, target, map[string]string{"file": "old", "stale": "old"})
+	writeFiles(t, staging, map[string]string{"file": "new", "dir/file": "new"})
+	s := Session{Log: logr.Discard()}
+	if err := s.swapStagedFiles(target, staging); err != nil {
+		t.Fatalf("swapStagedFiles() failed: %v", err)
+	}
+	want := map[string]string{"file": "new", "dir": "/", "dir/file": "new"}
+	if got := readFiles(t, target); !reflect.DeepEqual(got, want) {
+		t.Errorf("target files = %v, want %v", got, want)
+	}
+}
+
+func TestRecoverStagedRestore(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  map[string]string
+	}{
+		{
+			name: "crash before the end of the swap",
+			files: map[string]string{
+				"file":                 "new",
+				"added":                "new",
+				OLD_DIR + "/file":      "old",
+				OLD_DIR + "/stale":     "old",
+				STAGING_DIR + "/other": "new",
+				"kept":                 "old",
+			},
+			want: map[string]string{"file": "old", "stale": "old", "added": "new", "kept": "old"},
+		},
+		{
+			name: "crash while removing the old files",
+			files: map[string]string{
+				"file":             "new",
+				"added":            "new",
+				OLD_DIR + "/stale": "old",
+				SWAPPED_MARKER:     "",
+			},
+			want: map[string]string{"file": "new", "added": "new"},
+		},
+		{
+			name:  "nothing to recover",
+			files: map[string]string{"file": "new"},
+			want:  map[string]string{"file": "new"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			target := filepath.Join(parent, "data")
+			writeFiles(t, target, tt.files)
+			// The old files exchanged with the target by a restore that crashed before removing them
+			writeFiles(t, siblingStagingDir(target), map[string]string{"file": "older"})
+			s := Session{Log: logr.Discard()}
+			if err := s.recoverStagedRestore(target); err != nil {
+				t.Fatalf("recoverStagedRestore() failed: %v", err)
+			}
+			if got := readFiles(t, target); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("target files = %v, want %v", got, tt.want)
+			}
+			if _, err := os.Lstat(siblingStagingDir(target)); !os.IsNotExist(err) {
+				t.Errorf("the staging directory next to the target is still there: %v", err)
+			}
+		})
+	}
+}
+
+// Runs a process tagged as the target container. Its root is the root of the test.
+func fakeTargetContainer(t *testing.T) {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("the Functions run in a chroot")
+	}
+	cmd := exec.Command("sleep", "60")
+	cmd.Env = []string{formolv1alpha1.TARGETCONTAINER_TAG}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+}
+
+func shellFunction(script string) formolv1alpha1.Function {
+	return formolv1alpha1.Function{
+		ObjectMeta: metav1.ObjectMeta{Name: "function"},
+		Spec:       corev1.Container{Command: []string{"/bin/sh"}, Args: []string{"-c", script}},
+	}
+}
+
+// A fake restic backing up its stdin and dumping the dump file of its directory
+const streamRestic = `case "$1" in
+backup)
+	for arg in "$@"; do echo "$arg"; done > "$FAKE_RESTIC_DIR/backup.args"
+	cat > "$FAKE_RESTIC_DIR/stdin"
+	echo '{"message_type":"summary","snapshot_id":"5678","total_duration":1}'
+	;;
+dump)
+	echo "$3" > "$FAKE_RESTIC_DIR/dump.path"
+	cat "$FAKE_RESTIC_DIR/dump" || exit 1
+	;;
+esac
+`
+
+func TestBackupFunctionStdout(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		wantErr bool
+	}{
+		{name: "backup", script: "echo 'FORMOL_OUTPUT LSN=0/16B3748' >&2; echo dump; echo of the database"},
+		{name: "failed Function", script: "echo partial; exit 3", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resticDir := fakeRestic(t, streamRestic)
+			fakeTargetContainer(t)
+			s := Session{Log: logr.Discard(), Name: "backupsession-1", Outputs: map[string]string{}}
+			result, err := s.backupFunctionStdout(shellFunction(tt.script), nil, "db.sql", BackupOptions{})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("backupFunctionStdout() of a failed Function succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("backupFunctionStdout() failed: %v", err)
+			}
+			if result.SnapshotId != "5678" {
+				t.Errorf("backupFunctionStdout() snapshot = %q, want 5678", result.SnapshotId)
+			}
+			if stdin, _ := os.ReadFile(filepath.Join(resticDir, "stdin")); string(stdin) != "dump\nof the database\n" {
+				t.Errorf("restic stdin = %q, want the Function stdout", stdin)
+			}
+			args, _ := os.ReadFile(filepath.Join(resticDir, "backup.args"))
+			if !strings.Contains(string(args), "--stdin\n--stdin-filename\ndb.sql\n") {
+				t.Errorf("restic args = %q, want --stdin --stdin-filename db.sql", args)
+			}
+			if s.Outputs["LSN"] != "0/16B3748" {
+				t.Errorf("Function outputs = %v, want the LSN", s.Outputs)
+			}
+		})
+	}
+}
+
+func TestRestoreFunctionStdin(t *testing.T) {
+	tests := []struct {
+		name    string
+		dump    bool
+		script  string
+		wantErr bool
+	}{
+		{name: "restore", dump: true, script: `cat > "$FAKE_RESTIC_DIR/restored"`},
+		{name: "failed dump", script: `cat > "$FAKE_RESTIC_DIR/restored"`, wantErr: true},
+		{name: "failed Function", dump: true, script: "exit 3", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resticDir := fakeRestic(t, streamRestic)
+			fakeTargetContainer(t)
+			if tt.dump {
+				if err := os.WriteFile(filepath.Join(resticDir, "dump"), []byte("dump of the database\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := Session{Log: logr.Discard(), Outputs: map[string]string{}}
+			err := s.restoreFunctionStdin(shellFunction(tt.script), nil, "5678", "db.sql")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("restoreFunctionStdin() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("restoreFunctionStdin() failed: %v", err)
+			}
+			if path, _ := os.ReadFile(filepath.Join(resticDir, "dump.path")); string(path) != "/db.sql\n" {
+				t.Errorf("restic dump path = %q, want /db.sql", path)
+			}
+			if restored, _ := os.ReadFile(filepath.Join(resticDir, "restored")); string(restored) != "dump of the database\n" {
+				t.Errorf("Function stdin = %q, want the dumped file", restored)
+			}
+		})
+	}
+}
+
+// A fake restic for the raw block volumes: the snapshot tags are in snapshots.json
+// and the dumped images hold the snapshot id
+const deviceRestic = `case "$1" in
+snapshots)
+	cat "$FAKE_RESTIC_DIR/snapshots.json"
+	;;
+backup)
+	for arg in "$@"; do echo "$arg"; done > "$FAKE_RESTIC_DIR/backup.args"
+	cat > "$FAKE_RESTIC_DIR/stdin"
+	echo '{"message_type":"summary","snapshot_id":"5678","total_duration":1}'
+	;;
+dump)
+	echo "$2 $3" >> "$FAKE_RESTIC_DIR/dumps"
+	printf "image from $2"
+	;;
+esac
+`
+
+func TestBackupDevice(t *testing.T) {
+	resticDir := fakeRestic(t, deviceRestic)
+	device := corev1.VolumeDevice{Name: "disk", DevicePath: filepath.Join(t.TempDir(), "xvda")}
+	if err := os.WriteFile(device.DevicePath, []byte("blocks"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := Session{Log: logr.Discard(), Name: "backupsession-1"}
+	// The image of the previous device is chained by the caller
+	options := BackupOptions{Tags: []string{DEVICE_TAG_PREFIX + "other=1234"}}
+	result, err := s.BackupDevice(device, options)
+	if err != nil || result.SnapshotId != "5678" {
+		t.Fatalf("BackupDevice() = %+v, %v, want snapshot 5678", result, err)
+	}
+	args := readLines(t, filepath.Join(resticDir, "backup.args"))
+	for _, want := range []string{DEVICE_TAG_PREFIX + "other=1234", IMAGE_TAG_PREFIX + "disk=disk.img", "--stdin", "disk.img"} {
+		if !contains(args, want) {
+			t.Errorf("restic args = %v, want %s", args, want)
+		}
+	}
+	if stdin, _ := os.ReadFile(filepath.Join(resticDir, "stdin")); string(stdin) != "blocks" {
+		t.Errorf("restic stdin = %q, want the device content", stdin)
+	}
+}
+
+func TestRestoreDevices(t *testing.T) {
+	resticDir := fakeRestic(t, deviceRestic)
+	// disk1 was backed up first. The snapshot is the image of disk2. disk3 has no image.
+	if err := os.WriteFile(filepath.Join(resticDir, "snapshots.json"), []byte(`[{"id":"5678","tags":["`+
+		DEVICE_TAG_PREFIX+`disk1=1234","`+IMAGE_TAG_PREFIX+`disk2=disk2.img"]}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	devices := []corev1.VolumeDevice{}
+	for _, name := range []string{"disk1", "disk2", "disk3"} {
+		device := corev1.VolumeDevice{Name: name, DevicePath: filepath.Join(dir, name)}
+		if err := os.WriteFile(device.DevicePath, []byte("untouched"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		devices = append(devices, device)
+	}
+	s := Session{Log: logr.Discard()}
+	if err := s.RestoreDevices(devices, "5678"); err != nil {
+		t.Fatalf("RestoreDevices() failed: %v", err)
+	}
+	for name, want := range map[string]string{"disk1": "image from 1234", "disk2": "image from 5678", "disk3": "untouched"} {
+		if got, _ := os.ReadFile(filepath.Join(dir, name)); string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	dumps := readLines(t, filepath.Join(resticDir, "dumps"))
+	sort.Strings(dumps)
+	if want := []string{"1234 /disk1.img", "5678 /disk2.img"}; !reflect.DeepEqual(dumps, want) {
+		t.Errorf("restic dumps = %v, want %v", dumps, want)
+	}
+}
+
+func TestGetLinkedSnapshots(t *testing.T) {
+	resticDir := fakeRestic(t, deviceRestic)
+	if err := os.WriteFile(filepath.Join(resticDir, "snapshots.json"), []byte(`[{"id":"5678","tags":["`+
+		DEVICE_TAG_PREFIX+`disk2=bbbb","`+DEVICE_TAG_PREFIX+`disk1=aaaa","`+
+		STREAM_TAG_PREFIX+`db.sql=cccc","`+STREAM_TAG_PREFIX+`self=5678","`+
+		OUTPUT_TAG_PREFIX+`id=dddd"]}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := Session{Log: logr.Discard()}
+	if got, want := s.GetLinkedSnapshots("5678"), []string{"aaaa", "bbbb", "cccc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetLinkedSnapshots() = %v, want %v", got, want)
+	}
+}
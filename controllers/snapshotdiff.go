@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// A file of a restic snapshot as listed by restic ls --json
+type snapshotNode struct {
+	StructType string    `json:"struct_type"`
+	Path       string    `json:"path"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	Mode       uint32    `json:"mode"`
+	Uid        uint32    `json:"uid"`
+	Gid        uint32    `json:"gid"`
+	Mtime      time.Time `json:"mtime"`
+	LinkTarget string    `json:"linktarget"`
+}
+
+// A file that differs between two snapshots
+type FileDiff struct {
+	Path      string `json:"path"`
+	Type      string `json:"type"`
+	OldSize   int64  `json:"oldSize"`
+	NewSize   int64  `json:"newSize"`
+	SizeDelta int64  `json:"sizeDelta"`
+}
+
+// The differences between two snapshots
+type SnapshotDiff struct {
+	From      string     `json:"from"`
+	To        string     `json:"to"`
+	Added     []FileDiff `json:"added"`
+	Removed   []FileDiff `json:"removed"`
+	Modified  []FileDiff `json:"modified"`
+	SizeDelta int64      `json:"sizeDelta"`
+}
+
+// Lists the files of the snapshot, or the files under the paths
+func (s Session) getSnapshotNodes(snapshotId string, paths ...string) (map[string]snapshotNode, error) {
+	cmd := ResticCommand(append([]string{"ls", "--json", snapshotId}, paths...)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		s.Log.Error(err, "unable to list the snapshot", "snapshotId", snapshotId)
+		return nil, err
+	}
+	nodes := make(map[string]snapshotNode)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		node := snapshotNode{}
+		if err = json.Unmarshal(scanner.Bytes(), &node); err != nil {
+			s.Log.Error(err, "unable to unmarshal json", "data", scanner.Text())
+			break
+		}
+		// The first line describes the snapshot itself
+		if node.StructType != "node" {
+			continue
+		}
+		nodes[node.Path] = node
+	}
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err != nil {
+		// restic is blocked writing the rest of the listing. A partial listing is useless.
+		s.Log.Error(err, "unable to read the snapshot listing", "snapshotId", snapshotId)
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	if err := cmd.Wait(); err != nil {
+		s.Log.Error(err, "unable to list the snapshot", "snapshotId", snapshotId)
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// Returns true if the file content or metadata changed.
+// The directories only change when they are added or removed.
+func nodeChanged(old snapshotNode, new snapshotNode) bool {
+	if old.Type != new.Type {
+		return true
+	}
+	if new.Type == "dir" {
+		return false
+	}
+	return old.Size != new.Size || !old.Mtime.Equal(new.Mtime) || old.Mode != new.Mode || old.LinkTarget != new.LinkTarget
+}
+
+// Compares the files of two snapshots
+func (s Session) DiffSnapshots(from string, to string) (diff SnapshotDiff, err error) {
+	oldNodes, err := s.getSnapshotNodes(from)
+	if err != nil {
+		return
+	}
+	newNodes, err := s.getSnapshotNodes(to)
+	if err != nil {
+		return
+	}
+	return diffNodes(from, to, oldNodes, newNodes), nil
+}
+
+// Compares the files listed in two snapshots
+func diffNodes(from string, to string, oldNodes map[string]snapshotNode, newNodes map[string]snapshotNode) (diff SnapshotDiff) {
+	diff = SnapshotDiff{
+		From:     from,
+		To:       to,
+		Added:    []FileDiff{},
+		Removed:  []FileDiff{},
+		Modified: []FileDiff{},
+	}
+	for path, new := range newNodes {
+		old, found := oldNodes[path]
+		switch {
+		case !found:
+			diff.Added = append(diff.Added, FileDiff{
+				Path:      path,
+				Type:      new.Type,
+				NewSize:   new.Size,
+				SizeDelta: new.Size,
+			})
+		case nodeChanged(old, new):
+			diff.Modified = append(diff.Modified, FileDiff{
+				Path:      path,
+				Type:      new.Type,
+				OldSize:   old.Size,
+				NewSize:   new.Size,
+				SizeDelta: new.Size - old.Size,
+			})
+		}
+	}
+	for path, old := range oldNodes {
+		if _, found := newNodes[path]; !found {
+			diff.Removed = append(diff.Removed, FileDiff{
+				Path:      path,
+				Type:      old.Type,
+				OldSize:   old.Size,
+				SizeDelta: -old.Size,
+			})
+		}
+	}
+	for _, files := range [][]FileDiff{diff.Added, diff.Removed, diff.Modified} {
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].Path < files[j].Path
+		})
+		for _, file := range files {
+			diff.SizeDelta += file.SizeDelta
+		}
+	}
+	return
+}
@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+func TestDiffNodes(t *testing.T) {
+	mtime := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	later := mtime.Add(time.Hour)
+	oldNodes := map[string]snapshotNode{
+		"/data":            {Path: "/data", Type: "dir", Mode: 0755, Mtime: mtime},
+		"/data/same":       {Path: "/data/same", Type: "file", Size: 10, Mode: 0644, Mtime: mtime},
+		"/data/grown":      {Path: "/data/grown", Type: "file", Size: 10, Mode: 0644, Mtime: mtime},
+		"/data/touched":    {Path: "/data/touched", Type: "file", Size: 10, Mode: 0644, Mtime: mtime},
+		"/data/chmoded":    {Path: "/data/chmoded", Type: "file", Size: 10, Mode: 0644, Mtime: mtime},
+		"/data/relinked":   {Path: "/data/relinked", Type: "symlink", Mtime: mtime, LinkTarget: "same"},
+		"/data/now-a-dir":  {Path: "/data/now-a-dir", Type: "file", Size: 5, Mode: 0644, Mtime: mtime},
+		"/data/removed":    {Path: "/data/removed", Type: "file", Size: 7, Mode: 0644, Mtime: mtime},
+		"/data/dir":        {Path: "/data/dir", Type: "dir", Mode: 0755, Mtime: mtime},
+		"/data/old-dir":    {Path: "/data/old-dir", Type: "dir", Mode: 0755, Mtime: mtime},
+		"/data/old-dir/f1": {Path: "/data/old-dir/f1", Type: "file", Size: 3, Mode: 0644, Mtime: mtime},
+	}
+	newNodes := map[string]snapshotNode{
+		"/data":           {Path: "/data", Type: "dir", Mode: 0755, Mtime: later},
+		"/data/same":      {Path: "/data/same", Type: "file", Size: 10, Mode: 0644, Mtime: mtime},
+		"/data/grown":     {Path: "/data/grown", Type: "file", Size: 25, Mode: 0644, Mtime: later},
+		"/data/touched":   {Path: "/data/touched", Type: "file", Size: 10, Mode: 0644, Mtime: later},
+		"/data/chmoded":   {Path: "/data/chmoded", Type: "file", Size: 10, Mode: 0600, Mtime: mtime},
+		"/data/relinked":  {Path: "/data/relinked", Type: "symlink", Mtime: mtime, LinkTarget: "grown"},
+		"/data/now-a-dir": {Path: "/data/now-a-dir", Type: "dir", Mode: 0755, Mtime: mtime},
+		"/data/dir":       {Path: "/data/dir", Type: "dir", Mode: 0700, Mtime: later},
+		"/data/added":     {Path: "/data/added", Type: "file", Size: 4, Mode: 0644, Mtime: later},
+	}
+	want := SnapshotDiff{
+		From: "old",
+		To:   "new",
+		Added: []FileDiff{
+			{Path: "/data/added", Type: "file", NewSize: 4, SizeDelta: 4},
+		},
+		Removed: []FileDiff{
+			{Path: "/data/old-dir", Type: "dir"},
+			{Path: "/data/old-dir/f1", Type: "file", OldSize: 3, SizeDelta: -3},
+			{Path: "/data/removed", Type: "file", OldSize: 7, SizeDelta: -7},
+		},
+		Modified: []FileDiff{
+			{Path: "/data/chmoded", Type: "file", OldSize: 10, NewSize: 10},
+			{Path: "/data/grown", Type: "file", OldSize: 10, NewSize: 25, SizeDelta: 15},
+			{Path: "/data/now-a-dir", Type: "dir", OldSize: 5, SizeDelta: -5},
+			{Path: "/data/relinked", Type: "symlink"},
+			{Path: "/data/touched", Type: "file", OldSize: 10, NewSize: 10},
+		},
+		SizeDelta: 4,
+	}
+	if got := diffNodes("old", "new", oldNodes, newNodes); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffNodes() = %+v, want %+v", got, want)
+	}
+}
+
+func TestDiffNodesIdentical(t *testing.T) {
+	nodes := map[string]snapshotNode{
+		"/data/file": {Path: "/data/file", Type: "file", Size: 10},
+	}
+	got := diffNodes("a", "b", nodes, nodes)
+	if len(got.Added)+len(got.Removed)+len(got.Modified) != 0 || got.SizeDelta != 0 {
+		t.Errorf("diffNodes() of identical snapshots = %+v, want no difference", got)
+	}
+	// The lists are empty, not null, in the JSON output
+	if got.Added == nil || got.Removed == nil || got.Modified == nil {
+		t.Errorf("diffNodes() returned nil lists: %+v", got)
+	}
+}
+
+func TestGetSnapshotNodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "listing",
+			script: `echo '{"struct_type":"snapshot","id":"1234"}'
+echo '{"struct_type":"node","path":"/data","type":"dir"}'
+echo '{"struct_type":"node","path":"/data/file","type":"file","size":3}'
+`,
+			want: []string{"/data", "/data/file"},
+		},
+		{
+			name: "invalid line followed by a long listing",
+			script: `echo '{"struct_type":"snapshot","id":"1234"}'
+echo 'garbage'
+i=0
+while [ $i -lt 20000 ]; do echo '{"struct_type":"node","path":"/data/file","type":"file"}'; i=$((i+1)); done
+`,
+			wantErr: true,
+		},
+		{
+			name: "line too long followed by a long listing",
+			script: `head -c 2000000 /dev/zero | tr '\0' x
+echo
+i=0
+while [ $i -lt 20000 ]; do echo '{"struct_type":"node","path":"/data/file","type":"file"}'; i=$((i+1)); done
+`,
+			wantErr: true,
+		},
+		{
+			name:    "restic fails",
+			script:  "echo 'no such snapshot' >&2\nexit 1\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeRestic(t, tt.script)
+			s := Session{Log: logr.Discard()}
+			type result struct {
+				nodes map[string]snapshotNode
+				err   error
+			}
+			done := make(chan result)
+			go func() {
+				nodes, err := s.getSnapshotNodes("1234")
+				done <- result{nodes, err}
+			}()
+			var got result
+			select {
+			case got = <-done:
+			case <-time.After(30 * time.Second):
+				t.Fatal("getSnapshotNodes() hangs")
+			}
+			if tt.wantErr {
+				if got.err == nil {
+					t.Fatalf("getSnapshotNodes() = %v, want an error", got.nodes)
+				}
+				return
+			}
+			if got.err != nil {
+				t.Fatalf("getSnapshotNodes() failed: %v", got.err)
+			}
+			paths := []string{}
+			for _, path := range tt.want {
+				if _, found := got.nodes[path]; found {
+					paths = append(paths, path)
+				}
+			}
+			if len(got.nodes) != len(tt.want) || !reflect.DeepEqual(paths, tt.want) {
+				t.Errorf("getSnapshotNodes() = %v, want the nodes %v", got.nodes, tt.want)
+			}
+		})
+	}
+}
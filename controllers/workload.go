@@ -0,0 +1,270 @@
+package controllers
+
+import (
+	"fmt"
+	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Annotation of the RestoreSession saving the replicas of a target scaled down for the restore
+	REPLICAS_ANNOTATION = ANNOTATION_PREFIX + "replicas."
+	// How long to wait for the target Pods to be gone
+	SCALE_DOWN_TIMEOUT = 10 * time.Minute
+	// Where the PVC receiving the clone of a target is mounted by the restore Job
+	CLONE_VOLUME_NAME = "formol-clone"
+	CLONE_MOUNT_PATH  = "/clone"
+)
+
+// Gets the replicas of the Deployment or the StatefulSet
+func getReplicas(obj client.Object) (*int32, error) {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		return o.Spec.Replicas, nil
+	case *appsv1.StatefulSet:
+		return o.Spec.Replicas, nil
+	}
+	return nil, fmt.Errorf("cannot scale %T", obj)
+}
+
+// Gets the number of Pods of the Deployment or the StatefulSet
+func getStatusReplicas(obj client.Object) int32 {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		return o.Status.Replicas
+	case *appsv1.StatefulSet:
+		return o.Status.Replicas
+	}
+	return 0
+}
+
+// Saves the replicas of the target in the RestoreSession and scales the target to 0
+func (s Session) scaleDownTarget(restoreSession *formolv1alpha1.RestoreSession, targetObject client.Object, targetName string) error {
+	if _, found := restoreSession.Annotations[REPLICAS_ANNOTATION+targetName]; !found {
+		replicas, err := getReplicas(targetObject)
+		if err != nil {
+			return err
+		}
+		saved := int32(1)
+		if replicas != nil {
+			saved = *replicas
+		}
+		if err := s.patchAnnotations(restoreSession, map[string]string{
+			REPLICAS_ANNOTATION + targetName: strconv.Itoa(int(saved)),
+		}); err != nil {
+			s.Log.Error(err, "unable to save the target replicas", "target", targetName)
+			return err
+		}
+	}
+	s.Log.V(0).Info("Scaling down the target", "target", targetName)
+	return s.scaleTarget(targetObject, 0)
+}
+
+// Scales the target back to the replicas saved in the RestoreSession.
+// Returns false if the target was not scaled down for the restore.
+func (s Session) ScaleUpTarget(restoreSession formolv1alpha1.RestoreSession, targetObject client.Object, targetName string) (bool, error) {
+	value, found := restoreSession.Annotations[REPLICAS_ANNOTATION+targetName]
+	if !found {
+		return false, nil
+	}
+	replicas, err := strconv.Atoi(value)
+	if err != nil {
+		return true, err
+	}
+	s.Log.V(0).Info("Scaling up the target", "target", targetName, "replicas", replicas)
+	return true, s.scaleTarget(targetObject, int32(replicas))
+}
+
+// Changes the replicas of the Deployment or the StatefulSet.
+// The Pod template is untouched so this does not trigger a rollout.
+func (s Session) scaleTarget(targetObject client.Object, replicas int32) error {
+	patch := client.MergeFrom(targetObject.DeepCopyObject().(client.Object))
+	switch o := targetObject.(type) {
+	case *appsv1.Deployment:
+		o.Spec.Replicas = &replicas
+	case *appsv1.StatefulSet:
+		o.Spec.Replicas = &replicas
+	default:
+		return fmt.Errorf("cannot scale %T", targetObject)
+	}
+	if err := s.Patch(s.Context, targetObject, patch); err != nil {
+		s.Log.Error(err, "unable to scale the target", "target", targetObject.GetName(), "replicas", replicas)
+		return err
+	}
+	return nil
+}
+
+// Waits for all the target Pods to be gone
+func (s Session) WaitForScaleDown(targetObject client.Object) error {
+	key := client.ObjectKeyFromObject(targetObject)
+	return wait.PollImmediate(5*time.Second, SCALE_DOWN_TIMEOUT, func() (bool, error) {
+		if err := s.Get(s.Context, key, targetObject); err != nil {
+			return false, err
+		}
+		return getStatusReplicas(targetObject) == 0, nil
+	})
+}
+
+// Gathers the volume mounts of all the target containers
+func getTargetVolumeMounts(target formolv1alpha1.Target, podSpec *corev1.PodSpec) (paths []string, vms []corev1.VolumeMount, err error) {
+	for _, container := range podSpec.Containers {
+		for _, targetContainer := range target.Containers {
+			if targetContainer.Name == container.Name {
+				containerPaths, containerVms := formolv1alpha1.GetVolumeMounts(container, targetContainer)
+			NEXT_PATH:
+				for _, containerPath := range containerPaths {
+					for _, path := range paths {
+						if path == containerPath {
+							continue NEXT_PATH
+						}
+					}
+					paths = append(paths, containerPath)
+				}
+			NEXT_VM:
+				for _, containerVm := range containerVms {
+					for _, vm := range vms {
+						if vm.MountPath == containerVm.MountPath {
+							if vm.Name != containerVm.Name || vm.SubPath != containerVm.SubPath {
+								err = fmt.Errorf("containers mount different volumes on %s", vm.MountPath)
+								return
+							}
+							continue NEXT_VM
+						}
+					}
+					vms = append(vms, containerVm)
+				}
+			}
+		}
+	}
+	return
+}
+
+// Gathers the raw block devices of all the target containers
+func getTargetVolumeDevices(target formolv1alpha1.Target, podSpec *corev1.PodSpec) (devices []corev1.VolumeDevice, err error) {
+	for _, container := range podSpec.Containers {
+		for _, targetContainer := range target.Containers {
+			if targetContainer.Name == container.Name {
+			NEXT_DEVICE:
+				for _, containerDevice := range container.VolumeDevices {
+					for _, device := range devices {
+						if device.Name == containerDevice.Name {
+							if device.DevicePath != containerDevice.DevicePath {
+								err = fmt.Errorf("containers attach volume %s on different devices", device.Name)
+								return
+							}
+							continue NEXT_DEVICE
+						}
+					}
+					devices = append(devices, containerDevice)
+				}
+			}
+		}
+	}
+	return
+}
+
+// Lists the volumes of the mounts and the devices once
+func volumeNames(vms []corev1.VolumeMount, devices []corev1.VolumeDevice) (names []string) {
+	seen := make(map[string]bool)
+	for _, vm := range vms {
+		if !seen[vm.Name] {
+			seen[vm.Name] = true
+			names = append(names, vm.Name)
+		}
+	}
+	for _, device := range devices {
+		if !seen[device.Name] {
+			seen[device.Name] = true
+			names = append(names, device.Name)
+		}
+	}
+	return
+}
+
+// Gathers the volume mounts of all the containers of the Pod
+func getPodVolumeMounts(podSpec *corev1.PodSpec) (vms []corev1.VolumeMount) {
+	for _, container := range podSpec.Containers {
+	NEXT_VM:
+		for _, containerVm := range container.VolumeMounts {
+			for _, vm := range vms {
+				if vm.MountPath == containerVm.MountPath {
+					continue NEXT_VM
+				}
+			}
+			containerVm.ReadOnly = false
+			vms = append(vms, containerVm)
+		}
+	}
+	return
+}
+
+// The volume, and the subpath, of the mount
+func volumeKey(vm corev1.VolumeMount) string {
+	if vm.SubPath != "" {
+		return vm.Name + "/" + vm.SubPath
+	}
+	return vm.Name
+}
+
+// Tags the snapshot with the volumes holding the backup paths and where they were mounted
+// so the paths can be restored where the volumes are mounted at restore time.
+func (s Session) GetVolumeTags(target formolv1alpha1.Target, paths []string) (tags []string) {
+	targetObject, targetPodSpec := formolv1alpha1.GetTargetObjects(target.TargetKind)
+	if err := s.Get(s.Context, client.ObjectKey{
+		Namespace: s.Namespace,
+		Name:      target.TargetName,
+	}, targetObject); err != nil {
+		s.Log.Error(err, "unable to get the target. The snapshot won't have the volume tags", "target", target.TargetName)
+		return
+	}
+	vms := getPodVolumeMounts(targetPodSpec)
+	for _, path := range paths {
+		// The volume mounted the closest to the path
+		var match *corev1.VolumeMount
+		for i, vm := range vms {
+			mountPath := strings.TrimSuffix(vm.MountPath, "/")
+			if path == mountPath || strings.HasPrefix(path, mountPath+"/") {
+				if match == nil || len(vm.MountPath) > len(match.MountPath) {
+					match = &vms[i]
+				}
+			}
+		}
+		if match != nil {
+			tag := VOLUME_TAG_PREFIX + volumeKey(*match) + "=" + match.MountPath
+			found := false
+			for _, t := range tags {
+				found = found || t == tag
+			}
+			if !found {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return
+}
+
+// Maps the mount paths of the volumes at backup time, found in the snapshot tags,
+// to the mount paths of the same volumes in the Pod
+func (s Session) GetVolumePathMap(snapshotId string, podSpec *corev1.PodSpec) map[string]string {
+	pathMap := make(map[string]string)
+	mounts := make(map[string]string)
+	for _, vm := range getPodVolumeMounts(podSpec) {
+		if _, found := mounts[volumeKey(vm)]; !found {
+			mounts[volumeKey(vm)] = vm.MountPath
+		}
+	}
+	for volume, backupPath := range getTagValues(s.getSnapshotTags(snapshotId), VOLUME_TAG_PREFIX) {
+		if restorePath, found := mounts[volume]; found && filepath.Clean(restorePath) != filepath.Clean(backupPath) {
+			s.Log.V(0).Info("the volume has moved", "volume", volume, "backup path", backupPath, "restore path", restorePath)
+			pathMap[filepath.Clean(backupPath)] = filepath.Clean(restorePath)
+		}
+	}
+	return pathMap
+}
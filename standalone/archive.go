@@ -0,0 +1,331 @@
+package standalone
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
+	"github.com/desmo999r/formolcli/controllers"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"os/exec"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The magic numbers of the compressed archives
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// Pipes the data through a command. Close waits for the command to finish.
+type commandPipe struct {
+	io.Closer
+	io.Writer
+	io.Reader
+	cmd *exec.Cmd
+}
+
+func (p commandPipe) Close() error {
+	if p.Reader != nil {
+		// The command fails if its output is not read to the end
+		io.Copy(io.Discard, p.Reader)
+	}
+	if err := p.Closer.Close(); err != nil {
+		return err
+	}
+	return p.cmd.Wait()
+}
+
+// Compresses the archive according to the extension of the file name:
+// .zst with the zstd command, .gz or .tgz with gzip, anything else is not compressed
+func compressArchive(w io.Writer, fileName string) (io.WriteCloser, error) {
+	switch {
+	case strings.HasSuffix(fileName, ".zst"):
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return commandPipe{Closer: stdin, Writer: stdin, cmd: cmd}, nil
+	case strings.HasSuffix(fileName, ".gz"), strings.HasSuffix(fileName, ".tgz"):
+		return gzip.NewWriter(w), nil
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Decompresses the archive according to its magic number
+func decompressArchive(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		cmd := exec.Command("zstd", "-d", "-q", "-c")
+		cmd.Stdin = buffered
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return commandPipe{Closer: stdout, Reader: stdout, cmd: cmd}, nil
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buffered)
+	default:
+		return io.NopCloser(buffered), nil
+	}
+}
+
+// Gets the Functions run by the target
+func getTargetFunctions(backupConf formolv1alpha1.BackupConfiguration, targetName string) (functions []formolv1alpha1.Function) {
+	log := session.Log.WithName("GetTargetFunctions")
+	names := []string{}
+	for _, target := range backupConf.Spec.Targets {
+		if target.TargetName != targetName {
+			continue
+		}
+		for _, container := range target.Containers {
+			for _, step := range container.Steps {
+				for _, name := range []*string{step.Initialize, step.Finalize} {
+					if name != nil {
+						names = append(names, *name)
+					}
+				}
+			}
+			for _, job := range container.Job {
+				for _, name := range []*string{job.Backup, job.Restore} {
+					if name != nil {
+						names = append(names, *name)
+					}
+				}
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		function := formolv1alpha1.Function{}
+		if err := session.Get(session.Context, client.ObjectKey{
+			Namespace: backupConf.Namespace,
+			Name:      name,
+		}, &function); err != nil {
+			log.Error(err, "unable to get the function. Not adding it to the manifest", "function", name)
+			continue
+		}
+		function.ManagedFields = nil
+		functions = append(functions, function)
+	}
+	return
+}
+
+// Exports the snapshot of the target with the BackupSession, the BackupConfiguration
+// and the Functions definitions as a portable archive
+func ExportSnapshot(namespace string, backupSessionName string, targetName string, fileName string) (err error) {
+	log := session.Log.WithName("ExportSnapshot")
+	backupSession := formolv1alpha1.BackupSession{}
+	if err = session.Get(session.Context, client.ObjectKey{
+		Namespace: namespace,
+		Name:      backupSessionName,
+	}, &backupSession); err != nil {
+		log.Error(err, "unable to get backupsession", "name", backupSessionName, "namespace", namespace)
+		return
+	}
+	backupConf, err := setSnapshotEnv(backupSession.Spec.Ref.Namespace, backupSession.Spec.Ref.Name)
+	if err != nil {
+		return
+	}
+	if targetName == "" && len(backupSession.Status.Targets) == 1 {
+		targetName = backupSession.Status.Targets[0].TargetName
+	}
+	snapshotId, err := resolveSnapshot(namespace, backupSessionName, targetName)
+	if err != nil {
+		log.Error(err, "unable to find the snapshot", "backupsession", backupSessionName)
+		return
+	}
+	manifest := controllers.ArchiveManifest{
+		Version:             controllers.ARCHIVE_VERSION,
+		TargetName:          targetName,
+		BackupSession:       backupSession,
+		BackupConfiguration: backupConf,
+		Functions:           getTargetFunctions(backupConf, targetName),
+	}
+	manifest.BackupSession.ManagedFields = nil
+	manifest.BackupConfiguration.ManagedFields = nil
+	if manifest.Snapshot, err = session.GetSnapshot(snapshotId); err != nil {
+		return
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		log.Error(err, "unable to create the archive", "file", fileName)
+		return
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(fileName)
+		}
+	}()
+	archive, err := compressArchive(file, fileName)
+	if err != nil {
+		log.Error(err, "unable to compress the archive", "file", fileName)
+		return
+	}
+	err = session.ExportSnapshot(archive, manifest)
+	if closeErr := archive.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Error(err, "unable to export the snapshot", "snapshotId", snapshotId, "file", fileName)
+		return
+	}
+	log.V(0).Info("snapshot exported", "snapshotId", snapshotId, "file", fileName)
+	return
+}
+
+// Imports a snapshot archive in the repository of the BackupConfiguration and creates a
+// BackupSession of the target pointing at the new snapshot
+func ImportSnapshot(namespace string, name string, targetName string, fileName string) error {
+	log := session.Log.WithName("ImportSnapshot")
+	backupConf, err := setSnapshotEnv(namespace, name)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		log.Error(err, "unable to open the archive", "file", fileName)
+		return err
+	}
+	defer file.Close()
+	archive, err := decompressArchive(file)
+	if err != nil {
+		log.Error(err, "unable to decompress the archive", "file", fileName)
+		return err
+	}
+	dir, err := os.MkdirTemp("", "formol-import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	manifest, err := session.ExtractArchive(archive, dir)
+	if closeErr := archive.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Error(err, "unable to extract the archive", "file", fileName)
+		return err
+	}
+	if targetName == "" {
+		targetName = manifest.TargetName
+	}
+	var target *formolv1alpha1.Target
+	for i := range backupConf.Spec.Targets {
+		if backupConf.Spec.Targets[i].TargetName == targetName {
+			target = &backupConf.Spec.Targets[i]
+		}
+	}
+	if target == nil {
+		err := fmt.Errorf("backupconfiguration %s has no target %s", name, targetName)
+		log.Error(err, "unable to import the snapshot")
+		return err
+	}
+	// The new snapshot is tagged with the name of its BackupSession
+	session.Name = strings.Join([]string{BACKUPSESSION_PREFIX, name, strconv.FormatInt(time.Now().Unix(), 10)}, "-")
+	result, err := session.BackupImport(dir, manifest, controllers.GetBackupOptions(backupConf, targetName))
+	if err != nil {
+		log.Error(err, "unable to import the snapshot", "snapshotId", manifest.Snapshot.Id)
+		return err
+	}
+	annotations := map[string]string{
+		controllers.IMPORTED_ANNOTATION: manifest.Snapshot.Id,
+	}
+	for _, t := range backupConf.Spec.Targets {
+		if t.TargetName != targetName {
+			annotations[controllers.STATUS_ANNOTATION_PREFIX+controllers.REASON_NOTE+"."+t.TargetName] = controllers.NOT_IMPORTED_REASON
+		}
+	}
+	backupSession := formolv1alpha1.BackupSession{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        session.Name,
+			Namespace:   namespace,
+			Annotations: annotations,
+		},
+		Spec: formolv1alpha1.BackupSessionSpec{
+			Ref: corev1.ObjectReference{
+				Namespace: namespace,
+				Name:      name,
+			},
+		},
+	}
+	// Don't leave the imported snapshots behind without a BackupSession
+	forgetSnapshot := func() {
+		snapshotIds := append([]string{result.SnapshotId}, session.GetLinkedSnapshots(result.SnapshotId)...)
+		if output, err := controllers.ResticCommand(append([]string{"forget"}, snapshotIds...)...).CombinedOutput(); err != nil {
+			log.Error(err, "unable to forget the imported snapshots", "snapshotIds", snapshotIds, "output", string(output))
+		}
+	}
+	// The formol operator must skip the BackupSessions with the imported annotation like the sidecar does.
+	// Otherwise it starts a backup of the new BackupSession before its status is set below.
+	if err := session.Create(session.Context, &backupSession); err != nil {
+		log.Error(err, "unable to create backupsession")
+		forgetSnapshot()
+		return err
+	}
+	// The status is indexed like the targets of the BackupConfiguration.
+	// The other targets are not in the snapshot and cannot be restored. They have no state:
+	// they were not part of the export and did not fail.
+	startTime := metav1.NewTime(manifest.Snapshot.Time)
+	backupSession.Status = formolv1alpha1.BackupSessionStatus{
+		SessionState: formolv1alpha1.Success,
+		StartTime:    &startTime,
+	}
+	for _, t := range backupConf.Spec.Targets {
+		targetStatus := formolv1alpha1.TargetStatus{
+			BackupType:   t.BackupType,
+			TargetName:   t.TargetName,
+			TargetKind:   t.TargetKind,
+			StartTime:    &startTime,
+		}
+		if t.TargetName == targetName {
+			targetStatus.SessionState = formolv1alpha1.Success
+			targetStatus.SnapshotId = result.SnapshotId
+		}
+		backupSession.Status.Targets = append(backupSession.Status.Targets, targetStatus)
+	}
+	if err := session.Status().Update(session.Context, &backupSession); err != nil {
+		// The operator may have started a backup of the new BackupSession.
+		// Don't leave it behind as a half imported session.
+		log.Error(err, "unable to update the backupsession status. Deleting it", "backupsession", backupSession.Name)
+		if err := session.Delete(session.Context, &backupSession); err != nil {
+			log.Error(err, "unable to delete the backupsession", "backupsession", backupSession.Name)
+		}
+		forgetSnapshot()
+		return err
+	}
+	log.V(0).Info("snapshot imported", "snapshotId", result.SnapshotId, "backupsession", backupSession.Name)
+	return nil
+}
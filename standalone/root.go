@@ -2,6 +2,7 @@ package standalone
 
 import (
 	"context"
+	"fmt"
 	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
 	"github.com/desmo999r/formolcli/controllers"
 	volumesnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
@@ -13,7 +14,6 @@ import (
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"os"
-	"os/exec"
 	"path/filepath"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -61,12 +61,6 @@ func BackupPaths(
 	targetName string,
 	paths ...string) error {
 	log := session.Log.WithName("BackupPaths")
-	backupResult, err := session.BackupPaths(paths)
-	log.V(0).Info("Backup Job is over", "target", targetName, "snapshotID", backupResult.SnapshotId, "duration", backupResult.Duration)
-	if err != nil {
-		log.Error(err, "unable to backup paths", "paths", paths)
-		return err
-	}
 	backupSession := formolv1alpha1.BackupSession{}
 	if err := session.Get(session.Context, client.ObjectKey{
 		Name:      backupSessionName,
@@ -75,108 +69,219 @@ func BackupPaths(
 		log.Error(err, "unable to get backupsession", "name", backupSessionName, "namespace", backupSessionNamespace)
 		return err
 	}
-	for i, target := range backupSession.Status.Targets {
+	// The snapshot is tagged with the BackupSession name
+	session.Name = backupSessionName
+	session.Namespace = backupSessionNamespace
+	backupConf := formolv1alpha1.BackupConfiguration{}
+	if err := session.Get(session.Context, client.ObjectKey{
+		Namespace: backupSession.Spec.Ref.Namespace,
+		Name:      backupSession.Spec.Ref.Name,
+	}, &backupConf); err != nil {
+		log.Error(err, "unable to get the BackupConf")
+		return err
+	}
+	backupOptions := controllers.GetBackupOptions(backupConf, targetName)
+	// The outputs of the Functions that ran in the sidecar tag the snapshot
+	session.Outputs = controllers.GetOutputs(&backupSession, targetName)
+	backupOptions.Tags = append(backupOptions.Tags, session.OutputTags()...)
+	for _, target := range backupConf.Spec.Targets {
 		if target.TargetName == targetName {
-			backupSession.Status.Targets[i].SessionState = formolv1alpha1.Success
-			backupSession.Status.Targets[i].SnapshotId = backupResult.SnapshotId
-			backupSession.Status.Targets[i].Duration = &metav1.Duration{Duration: time.Now().Sub(backupSession.Status.Targets[i].StartTime.Time)}
-			if err := session.Status().Update(session.Context, &backupSession); err != nil {
-				log.Error(err, "unable to update backupSession status")
-				return err
-			}
+			backupOptions.Tags = append(backupOptions.Tags, session.GetVolumeTags(target, paths)...)
 		}
 	}
-	// Now find the PVC, VolumeSnapshots with the right label backupsession
-	// and delete them
-	vss := volumesnapshotv1.VolumeSnapshotList{}
-	if err := session.List(session.Context, &vss, client.InNamespace(backupSessionNamespace), client.MatchingLabels{"backupsession": backupSessionName}); err != nil {
-		log.Error(err, "unable to list the volumesnapshots", "backupsession", backupSessionName)
-		return err
+	var backupResult controllers.BackupResult
+	// The images of the raw block volumes reference each other
+	// so the last snapshot knows about all of them.
+	for _, device := range controllers.GetBackupDevices() {
+		result, err := session.BackupDevice(device, backupOptions)
+		if err != nil {
+			log.Error(err, "unable to backup device", "device", device.DevicePath)
+			return err
+		}
+		backupResult = result
+		backupOptions.Tags = append(backupOptions.Tags, controllers.DEVICE_TAG_PREFIX+device.Name+"="+result.SnapshotId)
 	}
-	for _, vs := range vss.Items {
-		if err := session.Delete(session.Context, &vs); err != nil {
-			log.Error(err, "unable to delete volumesnapshot", "vs", vs.Name)
+	if len(paths) > 0 {
+		result, err := session.BackupPaths(paths, backupOptions)
+		if err != nil {
+			log.Error(err, "unable to backup paths", "paths", paths)
 			return err
 		}
-		log.V(0).Info("volumesnapshot deleted", "vs", vs.Name)
+		backupResult = result
 	}
-	pvcs := corev1.PersistentVolumeClaimList{}
-	if err := session.List(session.Context, &pvcs, client.InNamespace(backupSessionNamespace), client.MatchingLabels{"backupsession": backupSessionName}); err != nil {
-		log.Error(err, "unable to list the PVCs", "backupsession", backupSessionName)
+	log.V(0).Info("Backup Job is over", "target", targetName, "snapshotID", backupResult.SnapshotId, "duration", backupResult.Duration)
+	if backupResult.SnapshotId == "" {
+		err := fmt.Errorf("nothing was backed up")
+		log.Error(err, "no snapshot", "target", targetName)
 		return err
 	}
-	for _, pvc := range pvcs.Items {
-		if err := session.Delete(session.Context, &pvc); err != nil {
-			log.Error(err, "unable to delete PVC", "pvc", pvc.Name)
-			return err
+	for i, target := range backupSession.Status.Targets {
+		if target.TargetName == targetName {
+			backupSession.Status.Targets[i].SessionState = formolv1alpha1.Success
+			backupSession.Status.Targets[i].SnapshotId = backupResult.SnapshotId
+			backupSession.Status.Targets[i].Duration = &metav1.Duration{Duration: time.Now().Sub(backupSession.Status.Targets[i].StartTime.Time)}
+			if err := session.Status().Update(session.Context, &backupSession); err != nil {
+				log.Error(err, "unable to update backupSession status")
+				return err
+			}
 		}
-		log.V(0).Info("PVC deleted", "pvc", pvc.Name)
 	}
-	return nil
+	// Now delete the PVC, VolumeSnapshots created for the backup
+	// unless the VolumeSnapshots are kept as restore points
+	return session.KeepSnapshotVolumes(backupConf, &backupSession, targetName)
 }
 
 func StartRestore(
 	restoreSessionName string,
 	restoreSessionNamespace string,
-	targetName string) {
+	targetName string) error {
 	log := session.Log.WithName("StartRestore")
-	if err := session.CheckRepo(); err != nil {
-		log.Error(err, "unable to check Repo")
-		return
-	}
 	restoreSession := formolv1alpha1.RestoreSession{}
 	if err := session.Get(session.Context, client.ObjectKey{
 		Name:      restoreSessionName,
 		Namespace: restoreSessionNamespace,
 	}, &restoreSession); err != nil {
+		// The restore Job fails and the RestoreSession controller deals with it
 		log.Error(err, "unable to get restoresession", "name", restoreSessionName, "namespace", restoreSessionNamespace)
-		return
-	}
-	backupSession := formolv1alpha1.BackupSession{
-		Spec:   restoreSession.Spec.BackupSessionRef.Spec,
-		Status: restoreSession.Spec.BackupSessionRef.Status,
+		return err
 	}
-	for i, target := range backupSession.Status.Targets {
+	for i, target := range restoreSession.Spec.BackupSessionRef.Status.Targets {
 		if target.TargetName == targetName {
+			return restoreTarget(&restoreSession, i, target)
+		}
+	}
+	err := fmt.Errorf("restoresession %s has no target %s", restoreSessionName, targetName)
+	log.Error(err, "unable to restore")
+	return err
+}
 
-			log.V(0).Info("StartRestore called", "restoring snapshot", target.SnapshotId)
-			cmd := exec.Command(controllers.RESTIC_EXEC, "restore", target.SnapshotId, "--target", "/")
-			// the restic restore command does not support JSON output
-			if output, err := cmd.CombinedOutput(); err != nil {
-				log.Error(err, "unable to restore snapshot", "output", output)
-				restoreSession.Status.Targets[i].SessionState = formolv1alpha1.Failure
-			} else {
-				restoreSession.Status.Targets[i].SessionState = formolv1alpha1.Waiting
-				log.V(0).Info("restore was a success. Moving to waiting state", "target", target.TargetName)
+// Restores the snapshot of the target and reports the result in the RestoreSession.
+// Whatever happens, the workload is scaled back up, or its restore initContainer removed.
+func restoreTarget(restoreSession *formolv1alpha1.RestoreSession, i int, target formolv1alpha1.TargetStatus) (err error) {
+	log := session.Log.WithName("StartRestore")
+	// The workload receiving the restore
+	workloadKind, workloadNamespace, workloadName := target.TargetKind, restoreSession.Namespace, target.TargetName
+	clone := controllers.GetCloneTarget(restoreSession, target.TargetName, target.TargetKind)
+	if clone != nil {
+		workloadKind, workloadNamespace, workloadName = clone.Kind, clone.Namespace, clone.Name
+	}
+	targetObject, targetPodSpec := formolv1alpha1.GetTargetObjects(workloadKind)
+	workloadFound := false
+	defer func() {
+		if err != nil {
+			restoreSession.Status.Targets[i].SessionState = formolv1alpha1.Failure
+		} else {
+			restoreSession.Status.Targets[i].SessionState = formolv1alpha1.Waiting
+			log.V(0).Info("restore was a success. Moving to waiting state", "target", target.TargetName)
+		}
+		// The status is updated first so the target sidecar knows the restore is over when it comes back
+		if updateErr := session.Status().Update(session.Context, restoreSession); updateErr != nil {
+			log.Error(updateErr, "unable to update RestoreSession", "restoreSession", restoreSession.Name)
+			if err == nil {
+				err = updateErr
 			}
-			if err := session.Status().Update(session.Context, &restoreSession); err != nil {
-				log.Error(err, "unable to update RestoreSession", "restoreSession", restoreSession)
-				return
+		}
+		if !workloadFound {
+			// The snapshot was restored in a new PVC
+			return
+		}
+		// Bring the target back so its sidecar runs the finalize steps
+		if scaled, scaleErr := session.ScaleUpTarget(*restoreSession, targetObject, target.TargetName); scaleErr != nil {
+			log.Error(scaleErr, "unable to scale up the target", "target", workloadName)
+			if err == nil {
+				err = scaleErr
 			}
-			log.V(0).Info("restore over. removing the initContainer")
-			targetObject, targetPodSpec := formolv1alpha1.GetTargetObjects(target.TargetKind)
-			if err := session.Get(session.Context, client.ObjectKey{
-				Namespace: restoreSessionNamespace,
-				Name:      target.TargetName,
-			}, targetObject); err != nil {
-				log.Error(err, "unable to get target objects", "target", target.TargetName)
-				return
+			return
+		} else if scaled {
+			log.V(0).Info("restore over. target scaled back up", "target", target.TargetName)
+			return
+		}
+		log.V(0).Info("restore over. removing the initContainer")
+		initContainers := []corev1.Container{}
+		for _, c := range targetPodSpec.InitContainers {
+			if c.Name == formolv1alpha1.RESTORECONTAINER_NAME {
+				continue
+			}
+			initContainers = append(initContainers, c)
+		}
+		targetPodSpec.InitContainers = initContainers
+		if updateErr := session.Update(session.Context, targetObject); updateErr != nil {
+			log.Error(updateErr, "unable to remove the restore initContainer", "targetObject", targetObject)
+			if err == nil {
+				err = updateErr
 			}
-			initContainers := []corev1.Container{}
-			for _, c := range targetPodSpec.InitContainers {
-				if c.Name == formolv1alpha1.RESTORECONTAINER_NAME {
-					continue
-				}
-				initContainers = append(initContainers, c)
+		}
+	}()
+	if workloadName != "" {
+		if err = session.Get(session.Context, client.ObjectKey{
+			Namespace: workloadNamespace,
+			Name:      workloadName,
+		}, targetObject); err != nil {
+			log.Error(err, "unable to get target objects", "target", workloadName)
+			return
+		}
+		workloadFound = true
+	}
+	if err = session.CheckRepo(); err != nil {
+		log.Error(err, "unable to check Repo")
+		return
+	}
+	if _, found := restoreSession.Annotations[controllers.REPLICAS_ANNOTATION+target.TargetName]; found && workloadFound {
+		// The volumes are restored by a Job. Wait for the target Pods to release them.
+		log.V(0).Info("waiting for the target to be scaled down", "target", target.TargetName)
+		if err = session.WaitForScaleDown(targetObject); err != nil {
+			log.Error(err, "target was not scaled down", "target", target.TargetName)
+			return
+		}
+	}
+
+	restoreOptions := controllers.GetRestoreOptions(restoreSession, target.TargetName)
+	if clone != nil && clone.PVC != "" {
+		// The paths are restored in the clone PVC
+		restoreOptions.Root = controllers.CLONE_MOUNT_PATH
+	} else {
+		// Restore the paths where their volumes are mounted now.
+		// The path-map option has the last word.
+		for from, to := range session.GetVolumePathMap(target.SnapshotId, targetPodSpec) {
+			if _, found := restoreOptions.PathMap[from]; !found {
+				restoreOptions.PathMap[from] = to
 			}
-			targetPodSpec.InitContainers = initContainers
-			if err := session.Update(session.Context, targetObject); err != nil {
-				log.Error(err, "unable to remove the restore initContainer", "targetObject", targetObject)
-				return
+		}
+	}
+	if controllers.RestoreFromVolumeSnapshots(restoreSession, target.TargetName) {
+		backupSessionName := restoreSession.Spec.BackupSessionRef.Ref.Name
+		log.V(0).Info("StartRestore called", "rolling back to the volume snapshots of", backupSessionName)
+		if err = session.RollbackVolumes(restoreSession.Namespace, backupSessionName, target.TargetName); err != nil {
+			log.Error(err, "unable to roll back the volumes")
+		}
+		return
+	}
+	if clone != nil || restoreOptions.PerPath() || session.IsImportedSnapshot(target.SnapshotId) {
+		log.V(0).Info("StartRestore called", "restoring snapshot", target.SnapshotId, "options", restoreOptions)
+		if err = session.RestoreSnapshot(target.SnapshotId, restoreOptions); err == nil {
+			// The raw block volumes of the workload, or of the clone
+			err = session.RestoreDevices(controllers.GetBackupDevices(), target.SnapshotId)
+		}
+	} else {
+		log.V(0).Info("StartRestore called", "restoring snapshot", target.SnapshotId)
+		devices := controllers.GetBackupDevices()
+		// The snapshot is a device image when only raw block volumes were backed up
+		if len(devices) == 0 || os.Getenv(formolv1alpha1.BACKUP_PATHS) != "" {
+			cmd := controllers.ResticCommand("restore", target.SnapshotId, "--target", "/")
+			// the restic restore command does not support JSON output
+			var output []byte
+			if output, err = cmd.CombinedOutput(); err != nil {
+				log.Error(err, "unable to restore snapshot", "output", output)
 			}
-			break
+		}
+		if err == nil && len(devices) > 0 {
+			err = session.RestoreDevices(devices, target.SnapshotId)
 		}
 	}
+	if err == nil {
+		err = session.RemapRestoredFiles(restoreSession, target.TargetName, target.SnapshotId, restoreOptions)
+	}
+	return
 }
 
 func CreateBackupSession(ref corev1.ObjectReference) {
@@ -201,23 +306,15 @@ func CreateBackupSession(ref corev1.ObjectReference) {
 
 func DeleteSnapshot(namespace string, name string, snapshotId string) {
 	log := session.Log.WithName("DeleteSnapshot")
-	session.Namespace = namespace
-	backupConf := formolv1alpha1.BackupConfiguration{}
-	if err := session.Get(session.Context, client.ObjectKey{
-		Namespace: namespace,
-		Name:      name,
-	}, &backupConf); err != nil {
-		log.Error(err, "unable to get the BackupConf")
-		return
-	}
-	if err := session.SetResticEnv(backupConf); err != nil {
-		log.Error(err, "unable to set the restic env")
+	if _, err := setSnapshotEnv(namespace, name); err != nil {
 		return
 	}
-	log.V(0).Info("deleting restic snapshot", "snapshotId", snapshotId)
-	cmd := exec.Command(controllers.RESTIC_EXEC, "forget", "--prune", snapshotId)
-	_, err := cmd.CombinedOutput()
+	// The streamed Functions and the raw block volumes of the backup have their own snapshots
+	snapshotIds := append([]string{snapshotId}, session.GetLinkedSnapshots(snapshotId)...)
+	log.V(0).Info("deleting restic snapshot", "snapshotId", snapshotId, "snapshotIds", snapshotIds)
+	cmd := controllers.ResticCommand(append([]string{"forget", "--prune"}, snapshotIds...)...)
+	output, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Error(err, "unable to delete snapshot", "snapshoId", snapshotId)
+		log.Error(err, "unable to delete snapshot", "snapshoId", snapshotId, "output", string(output))
 	}
 }
@@ -0,0 +1,222 @@
+package standalone
+
+import (
+	"encoding/json"
+	"fmt"
+	formolv1alpha1 "github.com/desmo999r/formol/api/v1alpha1"
+	"github.com/desmo999r/formolcli/controllers"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"os"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Sets the restic env of the BackupConfiguration repository
+func setSnapshotEnv(namespace string, name string) (backupConf formolv1alpha1.BackupConfiguration, err error) {
+	log := session.Log.WithName("SetSnapshotEnv")
+	session.Namespace = namespace
+	if err = session.Get(session.Context, client.ObjectKey{
+		Namespace: namespace,
+		Name:      name,
+	}, &backupConf); err != nil {
+		log.Error(err, "unable to get the BackupConf")
+		return
+	}
+	if err = session.SetResticEnv(backupConf); err != nil {
+		log.Error(err, "unable to set the restic env")
+	}
+	return
+}
+
+// Resolves a BackupSession name to the snapshot of the target.
+// Anything else is a restic snapshot id.
+func resolveSnapshot(namespace string, ref string, targetName string) (string, error) {
+	backupSession := formolv1alpha1.BackupSession{}
+	if err := session.Get(session.Context, client.ObjectKey{
+		Namespace: namespace,
+		Name:      ref,
+	}, &backupSession); err != nil {
+		if errors.IsNotFound(err) {
+			return ref, nil
+		}
+		return "", err
+	}
+	targets := backupSession.Status.Targets
+	if targetName == "" && len(targets) == 1 {
+		targetName = targets[0].TargetName
+	}
+	for _, target := range targets {
+		if target.TargetName == targetName {
+			if target.SnapshotId == "" {
+				return "", fmt.Errorf("backupsession %s has no snapshot for target %s", ref, targetName)
+			}
+			return target.SnapshotId, nil
+		}
+	}
+	if targetName == "" {
+		return "", fmt.Errorf("backupsession %s has several targets. Set the target name", ref)
+	}
+	return "", fmt.Errorf("backupsession %s has no target %s", ref, targetName)
+}
+
+// Runs restic and prints its output
+func runSnapshotCommand(args ...string) error {
+	cmd := controllers.ResticCommand(args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Lists the files of the snapshot under path
+func ListSnapshot(namespace string, name string, ref string, targetName string, path string) error {
+	log := session.Log.WithName("ListSnapshot")
+	if _, err := setSnapshotEnv(namespace, name); err != nil {
+		return err
+	}
+	snapshotId, err := resolveSnapshot(namespace, ref, targetName)
+	if err != nil {
+		log.Error(err, "unable to find the snapshot", "snapshot", ref)
+		return err
+	}
+	args := []string{"ls", "--long", snapshotId}
+	if path != "" {
+		args = append(args, path)
+	}
+	if err := runSnapshotCommand(args...); err != nil {
+		log.Error(err, "unable to list the snapshot", "snapshotId", snapshotId)
+		return err
+	}
+	return nil
+}
+
+// Finds the files matching the pattern in the snapshots of the target, or in all the snapshots
+func FindSnapshot(namespace string, name string, pattern string, targetName string) error {
+	log := session.Log.WithName("FindSnapshot")
+	backupConf, err := setSnapshotEnv(namespace, name)
+	if err != nil {
+		return err
+	}
+	args := []string{"find"}
+	if targetName != "" {
+		// The snapshots of the target share the same host
+		args = append(args, "--host", controllers.GetBackupOptions(backupConf, targetName).Host)
+	}
+	if err := runSnapshotCommand(append(args, pattern)...); err != nil {
+		log.Error(err, "unable to find the files", "pattern", pattern)
+		return err
+	}
+	return nil
+}
+
+// Writes the file of the snapshot to stdout
+func DumpSnapshot(namespace string, name string, ref string, targetName string, file string) error {
+	log := session.Log.WithName("DumpSnapshot")
+	if _, err := setSnapshotEnv(namespace, name); err != nil {
+		return err
+	}
+	snapshotId, err := resolveSnapshot(namespace, ref, targetName)
+	if err != nil {
+		log.Error(err, "unable to find the snapshot", "snapshot", ref)
+		return err
+	}
+	if err := runSnapshotCommand("dump", snapshotId, file); err != nil {
+		log.Error(err, "unable to dump the file", "snapshotId", snapshotId, "file", file)
+		return err
+	}
+	return nil
+}
+
+// Restores a single file of the target snapshot in the running target container.
+// This runs in the sidecar of the target.
+func RestoreFile(namespace string, backupSessionName string, targetName string, path string) error {
+	log := session.Log.WithName("RestoreFile")
+	backupSession := formolv1alpha1.BackupSession{}
+	if err := session.Get(session.Context, client.ObjectKey{
+		Namespace: namespace,
+		Name:      backupSessionName,
+	}, &backupSession); err != nil {
+		log.Error(err, "unable to get backupsession", "name", backupSessionName, "namespace", namespace)
+		return err
+	}
+	if _, err := setSnapshotEnv(backupSession.Spec.Ref.Namespace, backupSession.Spec.Ref.Name); err != nil {
+		return err
+	}
+	snapshotId, err := resolveSnapshot(namespace, backupSessionName, targetName)
+	if err != nil {
+		log.Error(err, "unable to find the snapshot", "backupsession", backupSessionName)
+		return err
+	}
+	if err := session.RestoreFile(snapshotId, path); err != nil {
+		log.Error(err, "unable to restore the file", "path", path)
+		return err
+	}
+	log.V(0).Info("file restored", "path", path, "snapshotId", snapshotId)
+	return nil
+}
+
+// Prints the files added, removed and modified between two snapshots of the target
+func DiffSnapshot(namespace string, name string, from string, to string, targetName string, output string) error {
+	log := session.Log.WithName("DiffSnapshot")
+	confNamespace := namespace
+	if name == "" {
+		// Compare the snapshots of a BackupSession with the repository of its BackupConfiguration
+		for _, ref := range []string{from, to} {
+			backupSession := formolv1alpha1.BackupSession{}
+			if err := session.Get(session.Context, client.ObjectKey{
+				Namespace: namespace,
+				Name:      ref,
+			}, &backupSession); err == nil {
+				confNamespace, name = backupSession.Spec.Ref.Namespace, backupSession.Spec.Ref.Name
+				break
+			} else if !errors.IsNotFound(err) {
+				log.Error(err, "unable to get backupsession", "name", ref, "namespace", namespace)
+				return err
+			}
+		}
+	}
+	if name == "" {
+		err := fmt.Errorf("no backupsession to compare. Set the name of the BackupConfiguration")
+		log.Error(err, "unable to find the repository of the snapshots")
+		return err
+	}
+	if _, err := setSnapshotEnv(confNamespace, name); err != nil {
+		return err
+	}
+	fromId, err := resolveSnapshot(namespace, from, targetName)
+	if err != nil {
+		log.Error(err, "unable to find the snapshot", "snapshot", from)
+		return err
+	}
+	toId, err := resolveSnapshot(namespace, to, targetName)
+	if err != nil {
+		log.Error(err, "unable to find the snapshot", "snapshot", to)
+		return err
+	}
+	diff, err := session.DiffSnapshots(fromId, toId)
+	if err != nil {
+		log.Error(err, "unable to compare the snapshots", "from", fromId, "to", toId)
+		return err
+	}
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(diff)
+	case "text", "":
+		for _, file := range diff.Added {
+			fmt.Printf("+ %s (%+d)\n", file.Path, file.SizeDelta)
+		}
+		for _, file := range diff.Removed {
+			fmt.Printf("- %s (%+d)\n", file.Path, file.SizeDelta)
+		}
+		for _, file := range diff.Modified {
+			fmt.Printf("M %s (%+d)\n", file.Path, file.SizeDelta)
+		}
+		fmt.Printf("%d added, %d removed, %d modified, size delta %+d bytes\n",
+			len(diff.Added), len(diff.Removed), len(diff.Modified), diff.SizeDelta)
+		return nil
+	default:
+		err := fmt.Errorf("unknown output format %s", output)
+		log.Error(err, "unable to print the diff")
+		return err
+	}
+}